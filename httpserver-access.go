@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RoleAnyUser in a rule's role list lets in every logged in user.
+const RoleAnyUser = "any"
+
+// RoleAdmin may change users and their roles.
+const RoleAdmin = "admin"
+
+// defaultAccess is used when the config file has no access section.
+var defaultAccess = map[string][]string{
+	"/debugForm":    {RoleAdmin},
+	"/debugQuery":   {RoleAdmin},
+	"/debug/":       {RoleAdmin},
+	"POST /users":   {RoleAdmin},
+	"PUT /user/":    {RoleAdmin},
+	"PATCH /user/":  {RoleAdmin},
+	"DELETE /user/": {RoleAdmin},
+}
+
+// route is a config key naming the requests a rule covers: "/debugForm",
+// "/user/" or "DELETE /user/". A trailing slash matches the whole subtree,
+// as with ServeMux, and "*" matches everything.
+type route struct {
+	method  string // "" for every method
+	pattern string
+}
+
+func parseRoute(key string) (route, error) {
+	rt := route{pattern: key}
+	if i := strings.IndexByte(key, ' '); i >= 0 {
+		rt.method, rt.pattern = key[:i], strings.TrimSpace(key[i+1:])
+	}
+	if rt.pattern != "*" && !strings.HasPrefix(rt.pattern, "/") {
+		return rt, fmt.Errorf("%q is not a path", key)
+	}
+	return rt, nil
+}
+
+func (rt route) matches(r *http.Request) bool {
+	if rt.method != "" && rt.method != r.Method {
+		return false
+	}
+	switch {
+	case rt.pattern == "*":
+		return true
+	case strings.HasSuffix(rt.pattern, "/"):
+		return strings.HasPrefix(r.URL.Path, rt.pattern)
+	}
+	return r.URL.Path == rt.pattern
+}
+
+// before orders routes most specific first: longer patterns, then method
+// specific ones, with "*" last.
+func (rt route) before(other route) bool {
+	if (rt.pattern == "*") != (other.pattern == "*") {
+		return other.pattern == "*"
+	}
+	if len(rt.pattern) != len(other.pattern) {
+		return len(rt.pattern) > len(other.pattern)
+	}
+	return rt.method > other.method
+}
+
+// accessRule limits a route to roles.
+type accessRule struct {
+	route
+	roles []string
+}
+
+// AccessPolicy maps routes to the roles allowed to use them. Routes it does
+// not mention are public. Keys are routes: "/debugForm", "/user/" or "DELETE /user/".
+type AccessPolicy struct {
+	mu    sync.RWMutex
+	rules []accessRule
+}
+
+// NewAccessPolicy parses the access section of the config file.
+func NewAccessPolicy(access map[string][]string) (*AccessPolicy, error) {
+	p := &AccessPolicy{}
+	for key, roles := range access {
+		rt, err := parseRoute(key)
+		if err != nil {
+			return nil, fmt.Errorf("access: %v", err)
+		}
+		rule := accessRule{route: rt, roles: roles}
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("access: %q lists no roles", key)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	sort.Slice(p.rules, func(i, j int) bool { return p.rules[i].before(p.rules[j].route) })
+	return p, nil
+}
+
+// Replace swaps in the rules of q, for config reloads.
+func (p *AccessPolicy) Replace(q *AccessPolicy) {
+	q.mu.RLock()
+	rules := q.rules
+	q.mu.RUnlock()
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+}
+
+// Roles returns the roles allowed to make r, or nil if it is public.
+func (p *AccessPolicy) Roles(r *http.Request) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if rule.matches(r) {
+			return rule.roles
+		}
+	}
+	return nil
+}
+
+// Middleware answers 401 to anonymous and 403 to logged in users
+// that lack every role the policy wants for the request.
+func (p *AccessPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roles := p.Roles(r)
+		if roles == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		username := CurrentUsername(r)
+		if username == "" {
+			w.Header().Set("WWW-Authenticate", `Cookie realm="httpserver", form-action="/login"`)
+			WriteError(w, r, NewHTTPError(http.StatusUnauthorized, "log in to use %s", r.URL.Path).WithCode("not_logged_in"))
+			return
+		}
+		user, err := UserStoreFor(r).Lookup(username)
+		if err != nil {
+			WriteError(w, r, NewHTTPError(http.StatusUnauthorized, "log in to use %s", r.URL.Path).WithCode("not_logged_in"))
+			return
+		}
+		if !user.HasAnyRole(roles) {
+			WriteError(w, r, NewHTTPError(http.StatusForbidden, "%s needs one of the roles %s", r.URL.Path, strings.Join(roles, ", ")).WithCode("forbidden"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HasAnyRole reports whether u has one of roles. RoleAnyUser matches everyone.
+func (u *User) HasAnyRole(roles []string) bool {
+	for _, want := range roles {
+		if want == RoleAnyUser {
+			return true
+		}
+		for _, have := range u.Roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// codings are the encodings Compress can produce, preferred first when the
+// client rates them equally. There is no brotli encoder in the standard
+// library; brotli still goes out for static files that have a .br sibling.
+var codings = []string{"gzip", "deflate"}
+
+// defaultCompressTypes is used when the config file has no compress_types.
+var defaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/javascript", "text/csv", "text/xml",
+	"application/json", "application/problem+json", "application/javascript",
+	"application/xml", "image/svg+xml",
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}},
+	// HTTP's "deflate" is the zlib format
+	"deflate": {New: func() interface{} {
+		w, _ := zlib.NewWriterLevel(nil, zlib.DefaultCompression)
+		return w
+	}},
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// negotiateCoding picks the coding the client rates highest, or "".
+func negotiateCoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, c := range codings {
+		if q := codingQuality(r, c); q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	return best
+}
+
+// Compress gzips or deflates responses whose Content-Type is in
+// compress_types once they reach compress_min_size bytes. It leaves alone
+// HEAD and Range requests and responses that already have a Content-Encoding,
+// such as precompressed static files.
+func Compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := Config()
+		if !settings.Compress || r.Method == "HEAD" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			coding:         negotiateCoding(r),
+			minSize:        settings.CompressMinSize,
+			types:          settings.CompressTypes,
+		}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// compressWriter holds back the start of a response until it knows
+// whether to compress it: when minSize bytes have been written, the
+// handler flushes, or the handler returns.
+type compressWriter struct {
+	http.ResponseWriter
+	coding  string // "" when the client takes no coding we have
+	minSize int
+	types   []string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder // nil when the response goes out as is
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided || status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.minSize {
+			if err := w.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decide sends the header and whatever has been held back, through an
+// encoder if the response is worth compressing.
+func (w *compressWriter) decide() error {
+	w.decided = true
+	h := w.Header()
+	if w.compressible() {
+		addVary(h, "Accept-Encoding")
+		if w.coding != "" && len(w.buf) >= w.minSize {
+			h.Set("Content-Encoding", w.coding)
+			h.Del("Content-Length")
+			// the bytes differ from the uncompressed response, but still
+			// match its validators for If-None-Match
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			w.enc = encoderPools[w.coding].Get().(encoder)
+			w.enc.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// compressible reports whether the response is of a type that compresses
+// well and has not been encoded already.
+func (w *compressWriter) compressible() bool {
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	ctype := h.Get("Content-Type")
+	if ctype == "" {
+		if len(w.buf) == 0 {
+			return false
+		}
+		ctype = http.DetectContentType(w.buf)
+		h.Set("Content-Type", ctype)
+	}
+	mt, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, t := range w.types {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds field to the Vary header unless it is already there.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided && w.status != 0 {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish sends a response that stayed under minSize and closes the encoder.
+func (w *compressWriter) finish() {
+	if !w.decided && w.status != 0 {
+		w.decide()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		encoderPools[w.coding].Put(w.enc)
+		w.enc = nil
+	}
+}
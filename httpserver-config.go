@@ -0,0 +1,574 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/l3x/jsoncfgo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Environment variables override the config file; command-line flags override both.
+const envPrefix = "WEBSERVER_"
+
+// Settings holds the web server configuration after layering
+// defaults, the jsoncfgo config file, environment variables and flags.
+type Settings struct {
+	ConfigPath    string
+	UsersPath     string
+	UserStore     string
+	UserStorePath string
+	Host          string
+	Port          int
+	Dir           string
+	TemplateDir   string
+	DevMode       bool // re-read templates on every request
+	RedirectCode  int
+
+	DirListing   bool              // list directories that have no index.html
+	CacheControl map[string]string // file extension (or "*") -> Cache-Control
+
+	Compress        bool
+	CompressMinSize int      // bytes; smaller responses are sent as they are
+	CompressTypes   []string // media types worth compressing
+
+	TLSCert          string
+	TLSKey           string
+	DevTLS           bool // serve a cached self-signed certificate for localhost
+	DevTLSDir        string
+	HTTPRedirectPort int // plain HTTP port that redirects to HTTPS; 0 for none
+
+	// http.Server timeouts; zero means none
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+
+	SessionStore  string // "memory" or "file"
+	SessionDir    string
+	SessionCookie string
+	SessionSecret string
+	SessionTTL    time.Duration
+	SessionRotate time.Duration
+	SessionSecure bool
+
+	PasswordlessLogin bool
+	PasswordCost      int
+	LoginMaxAttempts  int
+	LoginLockout      time.Duration
+
+	Access map[string][]string // route -> roles; see AccessPolicy
+
+	CORS CORSSettings // cross-origin callers of the JSON API
+
+	Limits map[string]RouteLimit // route (or "*") -> rate and body limits
+
+	Proxies map[string]ProxyRoute // path prefix -> upstream services
+
+	Rules map[string]RuleSettings // rule name -> redirect or rewrite
+
+	Sites       map[string]SiteSettings // host pattern -> site; see SiteTable
+	DefaultSite string                  // site for other hosts; "" for the top level
+
+	LogFormat string // "logfmt" or "json"
+	LogLevel  string // "debug", "info", "warn" or "error"
+
+	EventsReplay    int           // events kept for /events clients that reconnect
+	EventsHeartbeat time.Duration // how often /events streams send a keep-alive
+
+	// how often to look for changes to the config and users files;
+	// zero leaves reloading to SIGHUP
+	ReloadInterval time.Duration
+
+	Args []string // command-line arguments left after the flags
+}
+
+// ConfigError lists every problem found while loading the configuration,
+// so that all of them can be fixed in one go.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// LoadSettings parses args, reads the config file they point at and
+// applies environment and flag overrides on top of it. When the file reads
+// but does not validate, the *ConfigError comes with the settings as read.
+func LoadSettings(args []string) (*Settings, error) {
+	flags := flag.NewFlagSet("httpserver", flag.ContinueOnError)
+	configPath := flags.String("config", "data/webserver/webserver-config.json", "path to the webserver config file (env "+envPrefix+"CONFIG)")
+	usersPath := flags.String("users", "", "path to the users file (env "+envPrefix+"USERS, config key users)")
+	userStore := flags.String("user-store", "", "user store backend: file, memory or disk (env "+envPrefix+"USER_STORE, config key user_store)")
+	userStorePath := flags.String("user-store-path", "", "journal file of the disk user store (env "+envPrefix+"USER_STORE_PATH, config key user_store_path)")
+	host := flags.String("host", "", "host to listen on (env "+envPrefix+"HOST, config key host)")
+	port := flags.Int("port", 0, "port to listen on (env "+envPrefix+"PORT, config key port)")
+	dir := flags.String("dir", "", "directory of static files (env "+envPrefix+"DIR, config key dir)")
+	redirectCode := flags.Int("redirect-code", 0, "status code of redirect rules that name none (env "+envPrefix+"REDIRECT_CODE, config key redirect_code)")
+	dev := flags.Bool("dev", false, "development mode: reload templates on every request (env "+envPrefix+"DEV_MODE, config key dev_mode)")
+	devTLS := flags.Bool("dev-tls", false, "serve HTTPS with a self-signed certificate for localhost (env "+envPrefix+"DEV_TLS, config key dev_tls)")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	problems := &ConfigError{}
+	s := &Settings{ConfigPath: *configPath, Args: flags.Args()}
+	if !set["config"] {
+		s.ConfigPath = envString("CONFIG", s.ConfigPath)
+	}
+	if _, err := os.Stat(s.ConfigPath); err != nil {
+		problems.add("config file: %v", err)
+		return nil, problems
+	}
+
+	cfg, err := jsoncfgo.ReadFile(s.ConfigPath)
+	if err != nil {
+		problems.add("config file: %v", err)
+		return nil, problems
+	}
+	s.UsersPath = cfg.OptionalString("users", "data/webserver/users.json")
+	s.UserStore = cfg.OptionalString("user_store", "file")
+	s.UserStorePath = cfg.OptionalString("user_store_path", "data/webserver/users.journal")
+	s.Host = cfg.OptionalString("host", "localhost")
+	s.Port = cfg.OptionalInt("port", 8080)
+	s.Dir = cfg.OptionalString("dir", "www/")
+	s.TemplateDir = cfg.OptionalString("templates", "templates/")
+	s.DevMode = cfg.OptionalBool("dev_mode", false)
+	s.RedirectCode = cfg.OptionalInt("redirect_code", 307)
+	s.DirListing = cfg.OptionalBool("dir_listing", false)
+	s.CacheControl = map[string]string{}
+	if _, ok := cfg["cache_control"]; ok {
+		cacheControl := cfg.OptionalObject("cache_control")
+		for _, ext := range objKeys(cacheControl) {
+			if ext != "*" && !strings.HasPrefix(ext, ".") {
+				problems.add("cache_control: %q is not a file extension like \".html\" or \"*\"", ext)
+			}
+			s.CacheControl[strings.ToLower(ext)] = cacheControl.OptionalString(ext, "")
+		}
+		if err := cacheControl.Validate(); err != nil {
+			problems.add("cache_control: %v", err)
+		}
+	}
+	s.TLSCert = cfg.OptionalString("tls_cert", "")
+	s.TLSKey = cfg.OptionalString("tls_key", "")
+	s.DevTLS = cfg.OptionalBool("dev_tls", false)
+	s.DevTLSDir = cfg.OptionalString("dev_tls_dir", "data/webserver/dev-tls")
+	s.HTTPRedirectPort = cfg.OptionalInt("http_redirect_port", 0)
+	s.Compress = cfg.OptionalBool("compress", true)
+	s.CompressMinSize = cfg.OptionalInt("compress_min_size", 1024)
+	s.CompressTypes = defaultCompressTypes
+	if _, ok := cfg["compress_types"]; ok {
+		s.CompressTypes = cfg.OptionalList("compress_types")
+	}
+	s.LogFormat = cfg.OptionalString("log_format", "logfmt")
+	s.LogLevel = cfg.OptionalString("log_level", "info")
+	s.EventsReplay = cfg.OptionalInt("events_replay", 256)
+	s.EventsHeartbeat = seconds(problems, cfg, "events_heartbeat", 15)
+	s.ReloadInterval = seconds(problems, cfg, "reload_interval", 2)
+	s.ReadTimeout = seconds(problems, cfg, "read_timeout", 15)
+	s.ReadHeaderTimeout = seconds(problems, cfg, "read_header_timeout", 5)
+	s.WriteTimeout = seconds(problems, cfg, "write_timeout", 30)
+	s.IdleTimeout = seconds(problems, cfg, "idle_timeout", 120)
+	s.ShutdownTimeout = seconds(problems, cfg, "shutdown_timeout", 20)
+	s.SessionStore = cfg.OptionalString("session_store", "memory")
+	s.SessionDir = cfg.OptionalString("session_dir", "data/webserver/sessions")
+	s.SessionCookie = cfg.OptionalString("session_cookie", "testapp-session")
+	s.SessionSecret = envString("SESSION_SECRET", cfg.OptionalString("session_secret", ""))
+	s.SessionTTL = time.Duration(cfg.OptionalInt("session_ttl", 24*60*60)) * time.Second
+	s.SessionRotate = time.Duration(cfg.OptionalInt("session_rotate", 60*60)) * time.Second
+	s.SessionSecure = cfg.OptionalBool("session_secure", false)
+	s.PasswordlessLogin = cfg.OptionalBool("passwordless_login", false)
+	s.PasswordCost = cfg.OptionalInt("password_cost", bcrypt.DefaultCost)
+	s.LoginMaxAttempts = cfg.OptionalInt("login_max_attempts", 5)
+	s.LoginLockout = time.Duration(cfg.OptionalInt("login_lockout", 15*60)) * time.Second
+	s.Access = defaultAccess
+	if _, ok := cfg["access"]; ok {
+		s.Access = map[string][]string{}
+		access := cfg.OptionalObject("access")
+		for _, route := range objKeys(access) {
+			s.Access[route] = access.OptionalList(route)
+		}
+		if err := access.Validate(); err != nil {
+			problems.add("access: %v", err)
+		}
+	}
+	s.Limits = defaultLimits
+	if _, ok := cfg["limits"]; ok {
+		s.Limits = map[string]RouteLimit{}
+		limits := cfg.OptionalObject("limits")
+		for _, route := range objKeys(limits) {
+			limit := limits.OptionalObject(route)
+			s.Limits[route] = RouteLimit{
+				Rate:    limit.OptionalInt("rate", 0),
+				Burst:   limit.OptionalInt("burst", 0),
+				By:      limit.OptionalString("by", "user"),
+				MaxBody: limit.OptionalInt64("max_body", 0),
+			}
+			if err := limit.Validate(); err != nil {
+				problems.add("limits: %s: %v", route, err)
+			}
+		}
+		if err := limits.Validate(); err != nil {
+			problems.add("limits: %v", err)
+		}
+	}
+	s.Proxies = map[string]ProxyRoute{}
+	if _, ok := cfg["proxies"]; ok {
+		proxies := cfg.OptionalObject("proxies")
+		for _, prefix := range objKeys(proxies) {
+			proxy := proxies.OptionalObject(prefix)
+			s.Proxies[prefix] = ProxyRoute{
+				Upstreams:       upstreamSettings(problems, proxy, prefix),
+				Balance:         proxy.OptionalString("balance", "round_robin"),
+				StripPrefix:     proxy.OptionalBool("strip_prefix", false),
+				Timeout:         seconds(problems, proxy, "timeout", 30),
+				ConnectTimeout:  seconds(problems, proxy, "connect_timeout", 5),
+				Retries:         proxy.OptionalInt("retries", 1),
+				ForwardCookies:  proxy.OptionalBool("forward_cookies", false),
+				HealthPath:      proxy.OptionalString("health_path", ""),
+				HealthInterval:  seconds(problems, proxy, "health_interval", 10),
+				RequestHeaders:  stringMap(problems, proxy, "request_headers"),
+				ResponseHeaders: stringMap(problems, proxy, "response_headers"),
+			}
+			if err := proxy.Validate(); err != nil {
+				problems.add("proxies: %s: %v", prefix, err)
+			}
+		}
+		if err := proxies.Validate(); err != nil {
+			problems.add("proxies: %v", err)
+		}
+	}
+	s.Rules = defaultRules
+	if _, ok := cfg["rules"]; ok {
+		s.Rules = ruleSettings(problems, cfg.OptionalObject("rules"), "rules")
+	}
+	s.Sites = map[string]SiteSettings{}
+	if _, ok := cfg["sites"]; ok {
+		sites := cfg.OptionalObject("sites")
+		for _, host := range objKeys(sites) {
+			site := sites.OptionalObject(host)
+			ss := SiteSettings{
+				Dir:           site.OptionalString("dir", ""),
+				UserStore:     site.OptionalString("user_store", "file"),
+				UsersPath:     site.OptionalString("users", ""),
+				UserStorePath: site.OptionalString("user_store_path", ""),
+			}
+			if _, ok := site["routes"]; ok {
+				ss.Routes = append([]string{}, site.OptionalList("routes")...)
+			}
+			if _, ok := site["rules"]; ok {
+				ss.Rules = ruleSettings(problems, site.OptionalObject("rules"), "sites: "+host+": rules")
+			}
+			s.Sites[host] = ss
+			if err := site.Validate(); err != nil {
+				problems.add("sites: %s: %v", host, err)
+			}
+		}
+		if err := sites.Validate(); err != nil {
+			problems.add("sites: %v", err)
+		}
+	}
+	s.DefaultSite = cfg.OptionalString("default_site", "")
+	s.CORS = CORSSettings{
+		Methods:       defaultCORSMethods,
+		Headers:       defaultCORSHeaders,
+		ExposeHeaders: defaultCORSExposeHeaders,
+	}
+	if _, ok := cfg["cors"]; ok {
+		cors := cfg.OptionalObject("cors")
+		s.CORS.Origins = cors.OptionalList("origins")
+		if _, ok := cors["methods"]; ok {
+			s.CORS.Methods = nil
+			for _, m := range cors.OptionalList("methods") {
+				s.CORS.Methods = append(s.CORS.Methods, strings.ToUpper(m))
+			}
+		}
+		if _, ok := cors["headers"]; ok {
+			s.CORS.Headers = cors.OptionalList("headers")
+		}
+		if _, ok := cors["expose_headers"]; ok {
+			s.CORS.ExposeHeaders = cors.OptionalList("expose_headers")
+		}
+		s.CORS.Credentials = cors.OptionalBool("credentials", false)
+		s.CORS.MaxAge = seconds(problems, cors, "max_age", 600)
+		if err := cors.Validate(); err != nil {
+			problems.add("cors: %v", err)
+		}
+		for _, p := range s.CORS.validate() {
+			problems.add("%s", p)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		problems.add("%s: %v", s.ConfigPath, err)
+	}
+
+	s.UsersPath = layerString(set["users"], *usersPath, "USERS", s.UsersPath)
+	s.UserStore = layerString(set["user-store"], *userStore, "USER_STORE", s.UserStore)
+	s.UserStorePath = layerString(set["user-store-path"], *userStorePath, "USER_STORE_PATH", s.UserStorePath)
+	s.Host = layerString(set["host"], *host, "HOST", s.Host)
+	s.Dir = layerString(set["dir"], *dir, "DIR", s.Dir)
+	s.Port = layerInt(problems, set["port"], *port, "PORT", s.Port)
+	s.RedirectCode = layerInt(problems, set["redirect-code"], *redirectCode, "REDIRECT_CODE", s.RedirectCode)
+	s.LogFormat = layerString(false, "", "LOG_FORMAT", s.LogFormat)
+	s.LogLevel = layerString(false, "", "LOG_LEVEL", s.LogLevel)
+	s.DevTLS = layerBool(problems, set["dev-tls"], *devTLS, "DEV_TLS", s.DevTLS)
+	s.DevMode = layerBool(problems, set["dev"], *dev, "DEV_MODE", s.DevMode)
+	if s.TLSEnabled() {
+		s.SessionSecure = true
+	}
+
+	if s.Port < 1 || s.Port > 65535 {
+		problems.add("port: %d is not between 1 and 65535", s.Port)
+	}
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		problems.add("tls_cert and tls_key must be set together")
+	}
+	if s.HTTPRedirectPort != 0 {
+		if !s.TLSEnabled() {
+			problems.add("http_redirect_port: needs tls_cert and tls_key, or dev_tls")
+		} else if s.HTTPRedirectPort < 1 || s.HTTPRedirectPort > 65535 || s.HTTPRedirectPort == s.Port {
+			problems.add("http_redirect_port: %d is not a free port between 1 and 65535", s.HTTPRedirectPort)
+		}
+	}
+	if s.RedirectCode < 300 || s.RedirectCode > 399 {
+		problems.add("redirect_code: %d is not a 3xx status code", s.RedirectCode)
+	}
+	if fi, err := os.Stat(s.Dir); err != nil {
+		problems.add("dir: %v", err)
+	} else if !fi.IsDir() {
+		problems.add("dir: %s is not a directory", s.Dir)
+	}
+	if fi, err := os.Stat(s.TemplateDir); err != nil {
+		problems.add("templates: %v", err)
+	} else if !fi.IsDir() {
+		problems.add("templates: %s is not a directory", s.TemplateDir)
+	}
+	if _, err := os.Stat(s.UsersPath); err != nil {
+		problems.add("users: %v", err)
+	}
+	switch s.SessionStore {
+	case "memory", "file":
+	default:
+		problems.add("session_store: %q is not one of memory or file", s.SessionStore)
+	}
+	if s.SessionTTL <= 0 {
+		problems.add("session_ttl: must be a positive number of seconds")
+	}
+	if s.SessionSecret != "" && len(s.SessionSecret) < 32 {
+		problems.add("session_secret: must be at least 32 characters")
+	}
+	if s.PasswordCost < bcrypt.MinCost || s.PasswordCost > bcrypt.MaxCost {
+		problems.add("password_cost: %d is not between %d and %d", s.PasswordCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if s.CompressMinSize < 0 {
+		problems.add("compress_min_size: %d must not be negative", s.CompressMinSize)
+	}
+	if s.EventsReplay < 0 {
+		problems.add("events_replay: %d must not be negative", s.EventsReplay)
+	}
+	if s.EventsHeartbeat <= 0 {
+		problems.add("events_heartbeat: must be a positive number of seconds")
+	}
+	if s.LoginMaxAttempts < 1 {
+		problems.add("login_max_attempts: must be at least 1")
+	}
+	if _, err := NewLogger(s.LogFormat); err != nil {
+		problems.add("%v", err)
+	}
+	if _, err := parseLogLevel(s.LogLevel); err != nil {
+		problems.add("%v", err)
+	}
+	if _, err := NewAccessPolicy(s.Access); err != nil {
+		problems.add("%v", err)
+	}
+	if _, err := NewRateLimiter(s.Limits); err != nil {
+		problems.add("%v", err)
+	}
+	if _, err := NewRuleSet(s.Rules); err != nil {
+		problems.add("%v", err)
+	}
+	for host, site := range s.Sites {
+		if _, err := newSite(host, site); err != nil {
+			problems.add("%v", err)
+		}
+	}
+	checkSiteFiles(problems, s.Sites)
+	if _, ok := s.Sites[s.DefaultSite]; s.DefaultSite != "" && !ok {
+		problems.add("default_site: %q is not in sites", s.DefaultSite)
+	}
+	for prefix, route := range s.Proxies {
+		if _, err := NewProxy(prefix, route); err != nil {
+			problems.add("%v", err)
+		}
+	}
+	switch s.UserStore {
+	case "file", "memory", "disk":
+	default:
+		problems.add("user_store: %q is not one of file, memory or disk", s.UserStore)
+	}
+
+	if len(problems.Problems) > 0 {
+		return s, problems
+	}
+	return s, nil
+}
+
+// settingChange is one difference between two Settings.
+type settingChange struct {
+	Name     string
+	Old, New string
+}
+
+// Diff lists the settings that differ between s and other, in field order.
+func (s *Settings) Diff(other *Settings) []settingChange {
+	var changes []settingChange
+	a, b := reflect.ValueOf(s).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if name == "Args" || reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			continue
+		}
+		change := settingChange{name, fmt.Sprint(a.Field(i).Interface()), fmt.Sprint(b.Field(i).Interface())}
+		if name == "SessionSecret" {
+			change.Old, change.New = "(hidden)", "(hidden)"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// seconds reads a non-negative number of seconds from the config file.
+func seconds(problems *ConfigError, cfg jsoncfgo.Obj, key string, def int) time.Duration {
+	n := cfg.OptionalInt(key, def)
+	if n < 0 {
+		problems.add("%s: %d must not be negative", key, n)
+		return time.Duration(def) * time.Second
+	}
+	return time.Duration(n) * time.Second
+}
+
+// ruleSettings reads a rules section, keyed by rule name. section names
+// it in problems.
+func ruleSettings(problems *ConfigError, obj jsoncfgo.Obj, section string) map[string]RuleSettings {
+	rules := map[string]RuleSettings{}
+	for _, name := range objKeys(obj) {
+		rule := obj.OptionalObject(name)
+		rules[name] = RuleSettings{
+			Priority:      rule.OptionalInt("priority", 0),
+			Match:         rule.OptionalString("match", "exact"),
+			Path:          rule.OptionalString("path", ""),
+			Host:          rule.OptionalString("host", ""),
+			To:            rule.OptionalString("to", ""),
+			Status:        rule.OptionalInt("status", 0),
+			PreserveQuery: rule.OptionalBool("preserve_query", false),
+			Rewrite:       rule.OptionalBool("rewrite", false),
+		}
+		if err := rule.Validate(); err != nil {
+			problems.add("%s: %s: %v", section, name, err)
+		}
+	}
+	if err := obj.Validate(); err != nil {
+		problems.add("%s: %v", section, err)
+	}
+	return rules
+}
+
+// upstreamSettings reads the upstreams of the proxy route for prefix: a
+// list of URLs, or an object keyed by URL whose entries may set their own
+// timeout.
+func upstreamSettings(problems *ConfigError, proxy jsoncfgo.Obj, prefix string) []UpstreamSettings {
+	var upstreams []UpstreamSettings
+	if _, isList := proxy["upstreams"].([]interface{}); isList || proxy["upstreams"] == nil {
+		for _, raw := range proxy.OptionalList("upstreams") {
+			upstreams = append(upstreams, UpstreamSettings{URL: raw})
+		}
+		return upstreams
+	}
+	obj := proxy.OptionalObject("upstreams")
+	for _, raw := range objKeys(obj) {
+		entry := obj.OptionalObject(raw)
+		upstreams = append(upstreams, UpstreamSettings{URL: raw, Timeout: seconds(problems, entry, "timeout", 0)})
+		if err := entry.Validate(); err != nil {
+			problems.add("proxies: %s: %s: %v", prefix, raw, err)
+		}
+	}
+	if err := obj.Validate(); err != nil {
+		problems.add("proxies: %s: upstreams: %v", prefix, err)
+	}
+	return upstreams
+}
+
+// stringMap reads an object of strings, such as a set of headers.
+func stringMap(problems *ConfigError, cfg jsoncfgo.Obj, key string) map[string]string {
+	m := map[string]string{}
+	if _, ok := cfg[key]; !ok {
+		return m
+	}
+	obj := cfg.OptionalObject(key)
+	for _, k := range objKeys(obj) {
+		m[k] = obj.OptionalString(k, "")
+	}
+	if err := obj.Validate(); err != nil {
+		problems.add("%s: %v", key, err)
+	}
+	return m
+}
+
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(envPrefix + name); ok {
+		return v
+	}
+	return def
+}
+
+func layerString(flagSet bool, flagVal, envName, cfgVal string) string {
+	if flagSet {
+		return flagVal
+	}
+	return envString(envName, cfgVal)
+}
+
+func layerBool(problems *ConfigError, flagSet bool, flagVal bool, envName string, cfgVal bool) bool {
+	if flagSet {
+		return flagVal
+	}
+	v, ok := os.LookupEnv(envPrefix + envName)
+	if !ok {
+		return cfgVal
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		problems.add("%s%s: %q is not true or false", envPrefix, envName, v)
+		return cfgVal
+	}
+	return b
+}
+
+func layerInt(problems *ConfigError, flagSet bool, flagVal int, envName string, cfgVal int) int {
+	if flagSet {
+		return flagVal
+	}
+	v, ok := os.LookupEnv(envPrefix + envName)
+	if !ok {
+		return cfgVal
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		problems.add("%s%s: %q is not a number", envPrefix, envName, v)
+		return cfgVal
+	}
+	return n
+}
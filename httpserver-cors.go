@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSSettings is the cors section of the config file. With no origins
+// the server sends no CORS headers and browsers keep it same-origin.
+type CORSSettings struct {
+	Origins       []string // "https://app.example.com", "https://*.example.com", "http://localhost:*" or "*"
+	Methods       []string
+	Headers       []string // request headers callers may send
+	ExposeHeaders []string // response headers callers may read
+	Credentials   bool     // let callers send cookies
+	MaxAge        time.Duration
+}
+
+var (
+	defaultCORSMethods       = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	defaultCORSHeaders       = []string{"Content-Type", "X-CSRF-Token", "X-Request-ID"}
+	defaultCORSExposeHeaders = []string{"X-Request-ID", "Location"}
+)
+
+// validate returns a problem for each origin pattern that will never match.
+func (c *CORSSettings) validate() []string {
+	var problems []string
+	for _, o := range c.Origins {
+		if o == "*" {
+			if c.Credentials {
+				problems = append(problems, `cors: origin "*" cannot be combined with credentials`)
+			}
+			continue
+		}
+		scheme, host, ok := strings.Cut(o, "://")
+		if !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#@") || strings.Count(o, "*") > 1 {
+			problems = append(problems, fmt.Sprintf("cors: %q is not an origin like https://app.example.com or https://*.example.com", o))
+		}
+	}
+	return problems
+}
+
+// allowOrigin reports whether origin matches one of the configured patterns.
+// A * in a pattern stands for one or more letters, digits, dots and hyphens,
+// so "https://*.example.com" takes any subdomain and "http://localhost:*" any port.
+func (c *CORSSettings) allowOrigin(origin string) bool {
+	for _, pattern := range c.Origins {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if !ok || len(origin) <= len(prefix)+len(suffix) ||
+			!strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+			continue
+		}
+		if wildcardPart(origin[len(prefix) : len(origin)-len(suffix)]) {
+			return true
+		}
+	}
+	return false
+}
+
+func wildcardPart(s string) bool {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// trusts reports whether origin may make credentialed requests, which
+// means its scripts can read our pages, CSRF tokens included.
+func (c *CORSSettings) trusts(origin string) bool {
+	return c.Credentials && origin != "" && c.allowOrigin(origin)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS adds the cors section's headers to responses for allowed origins
+// and answers preflight OPTIONS requests itself.
+func CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &Config().CORS
+		if len(c.Origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		addVary(h, "Origin")
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !c.allowOrigin(origin) {
+			if preflight {
+				WriteError(w, r, NewHTTPError(http.StatusForbidden, "origin %q is not allowed", origin).WithCode("cors_origin"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if containsFold(c.Origins, "*") && !c.Credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.Credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if !preflight {
+			if len(c.ExposeHeaders) > 0 {
+				h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addVary(h, "Access-Control-Request-Method")
+		addVary(h, "Access-Control-Request-Headers")
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !containsFold(c.Methods, method) {
+			WriteError(w, r, NewHTTPError(http.StatusForbidden, "method %s is not allowed from %s", method, origin).WithCode("cors_method"))
+			return
+		}
+		for _, name := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			if name = strings.TrimSpace(name); name != "" && !containsFold(c.Headers, name) {
+				WriteError(w, r, NewHTTPError(http.StatusForbidden, "header %s is not allowed from %s", name, origin).WithCode("cors_header"))
+				return
+			}
+		}
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
+		if len(c.Headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
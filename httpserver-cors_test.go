@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// corsRequest sends method path from origin with header added and
+// returns the response with its body read.
+func corsRequest(t *testing.T, srv *httptest.Server, method, path, origin string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Origin", origin)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func withOrigins(credentials bool, origins ...string) func(*Settings) {
+	return func(s *Settings) {
+		s.CORS.Origins = origins
+		s.CORS.Credentials = credentials
+		s.CORS.MaxAge = 10 * time.Minute
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	srv := startTestServer(t, withOrigins(false, "https://app.example"))
+
+	resp, body := corsRequest(t, srv, "OPTIONS", "/user/alicesmith", "https://app.example", http.Header{
+		"Access-Control-Request-Method":  {"PATCH"},
+		"Access-Control-Request-Headers": {"content-type, x-csrf-token"},
+	})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("preflight: %s %s", resp.Status, body)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example",
+		"Access-Control-Allow-Methods":     strings.Join(defaultCORSMethods, ", "),
+		"Access-Control-Allow-Headers":     strings.Join(defaultCORSHeaders, ", "),
+		"Access-Control-Max-Age":           "600",
+		"Access-Control-Allow-Credentials": "",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	for _, token := range []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"} {
+		if !headerHasToken(resp.Header, "Vary", token) {
+			t.Errorf("Vary %q lacks %s", resp.Header.Values("Vary"), token)
+		}
+	}
+
+	for _, tt := range []struct {
+		origin, method, headers, code string
+	}{
+		{"https://evil.example", "PATCH", "", "cors_origin"},
+		{"https://app.example", "PROPFIND", "", "cors_method"},
+		{"https://app.example", "PATCH", "Content-Type, X-Evil", "cors_header"},
+	} {
+		header := http.Header{"Access-Control-Request-Method": {tt.method}}
+		if tt.headers != "" {
+			header.Set("Access-Control-Request-Headers", tt.headers)
+		}
+		resp, body := corsRequest(t, srv, "OPTIONS", "/user/alicesmith", tt.origin, header)
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, `"`+tt.code+`"`) {
+			t.Errorf("preflight of %s %s from %s: got %s %s, want 403 %s", tt.method, tt.headers, tt.origin, resp.Status, body, tt.code)
+		}
+		if tt.code == "cors_origin" && resp.Header.Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("a refused origin got Access-Control-Allow-Origin")
+		}
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	srv := startTestServer(t, withOrigins(false, "https://app.example", "http://localhost:*", "https://*.example.com"))
+
+	for origin, allowed := range map[string]bool{
+		"https://app.example":           true,
+		"http://app.example":            false,
+		"https://app.example.evil":      false,
+		"http://localhost:5173":         true,
+		"http://localhost:8080":         true,
+		"http://localhost":              false,
+		"https://localhost:5173":        false,
+		"https://a.example.com":         true,
+		"https://a.b.example.com":       true,
+		"https://example.com":           false,
+		"https://evilexample.com":       false,
+		"https://evil.com/.example.com": false,
+	} {
+		resp, body := corsRequest(t, srv, "GET", "/users", origin, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /users from %s: %s %s", origin, resp.Status, body)
+		}
+		acao := resp.Header.Get("Access-Control-Allow-Origin")
+		if allowed && acao != origin || !allowed && acao != "" {
+			t.Errorf("%s: Access-Control-Allow-Origin %q", origin, acao)
+		}
+		if expose := resp.Header.Get("Access-Control-Expose-Headers"); allowed != (expose != "") {
+			t.Errorf("%s: Access-Control-Expose-Headers %q", origin, expose)
+		}
+		// caches must not give one origin's answer to another
+		if !headerHasToken(resp.Header, "Vary", "Origin") {
+			t.Errorf("%s: Vary %q lacks Origin", origin, resp.Header.Values("Vary"))
+		}
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		credentials bool
+		origins     []string
+		acao, acac  string
+	}{
+		{"without credentials", false, []string{"https://app.example"}, "https://app.example", ""},
+		{"with credentials", true, []string{"https://app.example"}, "https://app.example", "true"},
+		{"any origin", false, []string{"*"}, "*", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startTestServer(t, withOrigins(tt.credentials, tt.origins...))
+			resp, _ := corsRequest(t, srv, "GET", "/users", "https://app.example", nil)
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.acao {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.acao)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Credentials"); got != tt.acac {
+				t.Errorf("Access-Control-Allow-Credentials %q, want %q", got, tt.acac)
+			}
+		})
+	}
+
+	t.Run("no origins", func(t *testing.T) {
+		srv := startTestServer(t, nil)
+		resp, _ := corsRequest(t, srv, "GET", "/users", "https://app.example", nil)
+		for _, name := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials"} {
+			if got := resp.Header.Get(name); got != "" {
+				t.Errorf("%s %q with no cors origins", name, got)
+			}
+		}
+		if headerHasToken(resp.Header, "Vary", "Origin") {
+			t.Errorf("Vary: Origin with no cors origins")
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"mime"
+	"net/http"
+)
+
+const (
+	csrfCookie   = "csrf_token"   // mirrors the token for scripts to read
+	csrfField    = "csrf_token"   // hidden form field
+	csrfHeader   = "X-CSRF-Token" // double-submit header for AJAX
+	csrfValueKey = "csrf"         // where a session keeps its token
+)
+
+const csrfKey contextKey = "csrf"
+
+// CSRF gives every visitor a token and refuses unsafe requests that do not
+// send it back, in the csrf_token form field or the X-CSRF-Token header.
+// A logged in user's token lives in the session; before login it only
+// lives in the csrf_token cookie, which the submitted token must match.
+//
+// Requests with neither a session cookie nor a body type a cross-site
+// form could send (urlencoded, multipart or text/plain) carry no ambient
+// credentials to abuse and are let through, so JSON API clients need no token.
+// Nor do origins the cors section lets send credentials: their scripts can
+// read our pages, and the token with them, anyway.
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := csrfToken(w, r)
+		r = r.WithContext(context.WithValue(r.Context(), csrfKey, token))
+		if !safeMethod(r.Method) && needsCSRFCheck(r) {
+			if err := checkCSRF(r, token); err != nil {
+				WriteError(w, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns the token to put in forms answering r.
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return token
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// csrfToken finds or makes the request's token and keeps the cookie in step.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	var token string
+	if sess := CurrentSession(r); sess != nil {
+		token = sess.Values[csrfValueKey]
+		if token == "" {
+			token = newSessionID()
+			if sess.Values == nil {
+				sess.Values = map[string]string{}
+			}
+			sess.Values[csrfValueKey] = token
+			if err := Sessions.Store.Save(sess); err != nil {
+				Logger.Error("saving CSRF token", "request_id", RequestID(r), "err", err)
+			}
+		}
+	} else if c, err := r.Cookie(csrfCookie); err == nil && len(c.Value) >= 32 {
+		token = c.Value
+	} else {
+		token = newSessionID()
+	}
+	if c, err := r.Cookie(csrfCookie); err != nil || c.Value != token {
+		setCSRFCookie(w, token)
+	}
+	return token
+}
+
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   Sessions.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func needsCSRFCheck(r *http.Request) bool {
+	if Config().CORS.trusts(r.Header.Get("Origin")) {
+		return false
+	}
+	if _, err := r.Cookie(Sessions.CookieName); err == nil {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+// checkCSRF fails with a 403 unless r sends token back, or with the 400
+// or 413 of a form that would not parse.
+func checkCSRF(r *http.Request, token string) error {
+	sent := r.Header.Get(csrfHeader)
+	if sent == "" {
+		err := r.ParseForm()
+		if err == nil {
+			// 32 MB in memory, as r.PostFormValue would
+			if err = r.ParseMultipartForm(32 << 20); err == http.ErrNotMultipart {
+				err = nil
+			}
+		}
+		if err != nil {
+			return badRequestBody(err, "error parsing form %v", err)
+		}
+		sent = r.PostForm.Get(csrfField)
+	}
+	if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		return NewHTTPError(http.StatusForbidden, "missing or invalid CSRF token").WithCode("csrf_failed")
+	}
+	return nil
+}
+
+// csrfFieldHTML is the csrfField template helper: {{csrfField .CSRFToken}}
+func csrfFieldHTML(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfField + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
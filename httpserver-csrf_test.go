@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// send makes a request with c's cookies but none of the tokens c.do adds:
+// the header, if token is not "", and origin, if not "".
+func (c *testClient) send(method, path, contentType, body, token, origin string) (*http.Response, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.base+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set(csrfHeader, token)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+const formType = "application/x-www-form-urlencoded"
+
+func TestCSRFRefuses(t *testing.T) {
+	srv := startTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+	token := c.cookie(csrfCookie)
+	if len(token) < 32 {
+		t.Fatalf("csrf cookie %q", token)
+	}
+
+	for _, tt := range []struct {
+		name, contentType, body, token string
+	}{
+		{"no token", "application/json", "{}", ""},
+		{"no token, a form", formType, "a=1", ""},
+		{"wrong header", "application/json", "{}", strings.Repeat("x", len(token))},
+		{"wrong field", formType, url.Values{csrfField: {strings.Repeat("x", len(token))}}.Encode(), ""},
+		{"cut short", "application/json", "{}", token[:len(token)-1]},
+	} {
+		resp, body := c.send("POST", "/logout", tt.contentType, tt.body, tt.token, "")
+		if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, `"csrf_failed"`) {
+			t.Errorf("%s: got %s %s, want 403 csrf_failed", tt.name, resp.Status, body)
+		}
+	}
+	if resp, body := c.do("GET", "/me", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("refused requests logged out: %s %s", resp.Status, body)
+	}
+
+	// before login the token is the cookie's, and forms still need it
+	anonymous := newTestClient(t, srv)
+	form := url.Values{"username": {"alicesmith"}}.Encode()
+	if resp, body := anonymous.send("POST", "/login", formType, form, "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("login form without a token: got %s %s, want 403", resp.Status, body)
+	}
+}
+
+func TestCSRFAccepts(t *testing.T) {
+	srv := startTestServer(t, func(s *Settings) {
+		s.CORS.Origins = []string{"https://app.example"}
+		s.CORS.Credentials = true
+	})
+
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+
+	// safe methods need no token
+	for _, method := range []string{"GET", "HEAD", "OPTIONS"} {
+		if resp, body := c.send(method, "/me", "", "", "", ""); resp.StatusCode == http.StatusForbidden {
+			t.Errorf("%s /me: %s %s", method, resp.Status, body)
+		}
+	}
+
+	// the origin the cors section lets send credentials
+	if resp, body := c.send("GET", "/me", "", "", "", "https://app.example"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /me: %s %s", resp.Status, body)
+	}
+	if resp, body := c.send("POST", "/logout", "application/json", "{}", "", "https://app.example"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("logout from a trusted origin: got %s %s, want 204", resp.Status, body)
+	}
+
+	// the token in a form field
+	c.login("alicesmith")
+	form := url.Values{csrfField: {c.cookie(csrfCookie)}}.Encode()
+	if resp, body := c.send("POST", "/logout", formType, form, "", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("logout form with the token: got %s %s, want 204", resp.Status, body)
+	}
+	if resp, _ := c.do("GET", "/me", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("still logged in after the logout form: %s", resp.Status)
+	}
+
+	// JSON without cookies carries nothing to forge, from anywhere
+	api := newTestClient(t, srv)
+	if resp, body := api.send("POST", "/login", "application/json", `{"username": "alicesmith"}`, "", "https://elsewhere.example"); resp.StatusCode != http.StatusOK {
+		t.Errorf("credential-less JSON login: got %s %s, want 200", resp.Status, body)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// HTTPError is an error that knows which status code it should be sent with.
+type HTTPError struct {
+	Status int
+	Code   string // machine readable, e.g. "user_not_found"
+	Msg    string
+	Fields fieldErrors
+}
+
+func NewHTTPError(status int, format string, args ...interface{}) *HTTPError {
+	return &HTTPError{Status: status, Code: statusCode(status), Msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *HTTPError) Error() string {
+	return e.Msg
+}
+
+func (e *HTTPError) WithCode(code string) *HTTPError {
+	e.Code = code
+	return e
+}
+
+func (e *HTTPError) WithFields(fields fieldErrors) *HTTPError {
+	e.Fields = fields
+	return e
+}
+
+// statusCode turns a status into a default machine readable code,
+// e.g. 404 becomes "not_found".
+func statusCode(status int) string {
+	switch status {
+	case http.StatusUnprocessableEntity:
+		return "validation_failed"
+	case http.StatusInternalServerError:
+		return "internal_error"
+	}
+	code := []byte(http.StatusText(status))
+	for i, c := range code {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			code[i] = c + 'a' - 'A'
+		case c == ' ' || c == '-':
+			code[i] = '_'
+		}
+	}
+	return string(code)
+}
+
+// StatusCoder is implemented by errors that carry their own HTTP status.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Err is a numbered application error, like the one in custom-error-handling.go.
+// Numbers from 4000 to 5999 carry their HTTP status in the first three
+// digits: 4041 is sent as a 404, 5031 as a 503. Other numbers are 500s.
+type Err struct {
+	errNo int
+	when  time.Time
+	msg   string
+}
+
+func NewErr(errNo int, msg string) *Err {
+	return &Err{errNo, time.Now(), msg}
+}
+
+func (e *Err) Error() string {
+	return fmt.Sprintf("%v [%d] %s", e.when, e.errNo, e.msg)
+}
+
+func (err Err) errorNumber() int {
+	return err.errNo
+}
+
+func (e *Err) StatusCode() int {
+	if e.errNo >= 4000 && e.errNo <= 5999 {
+		return e.errNo / 10
+	}
+	return http.StatusInternalServerError
+}
+
+// Problem is an RFC 7807 problem document.
+type Problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	Code      string      `json:"code"`
+	RequestID string      `json:"request_id,omitempty"`
+	Fields    fieldErrors `json:"fields,omitempty"`
+}
+
+// asHTTPError maps store errors, Errs, StatusCoders and plain errors onto
+// an HTTPError. The detail of 5xx errors is not shown to the client.
+func asHTTPError(err error) *HTTPError {
+	var e *HTTPError
+	var ae *Err
+	var sc StatusCoder
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.As(err, &ae):
+		status := ae.StatusCode()
+		if status >= 500 {
+			return NewHTTPError(status, "%s", http.StatusText(status)).WithCode(fmt.Sprintf("err_%d", ae.errorNumber()))
+		}
+		return NewHTTPError(status, "%s", ae.msg).WithCode(fmt.Sprintf("err_%d", ae.errorNumber()))
+	case errors.As(err, &sc):
+		status := sc.StatusCode()
+		if status >= 500 {
+			return NewHTTPError(status, "%s", http.StatusText(status))
+		}
+		return NewHTTPError(status, "%v", err)
+	case errors.Is(err, ErrUserNotFound):
+		return NewHTTPError(http.StatusNotFound, "%v", err).WithCode("user_not_found")
+	case errors.Is(err, ErrUserExists):
+		return NewHTTPError(http.StatusConflict, "%v", err).WithCode("user_exists")
+	}
+	return NewHTTPError(http.StatusInternalServerError, "internal server error")
+}
+
+func newProblem(r *http.Request, err error) *Problem {
+	e := asHTTPError(err)
+	return &Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(e.Status),
+		Status:    e.Status,
+		Detail:    e.Msg,
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		RequestID: RequestID(r),
+		Fields:    e.Fields,
+	}
+}
+
+// WriteError sends err to the client as a problem document, or as an HTML
+// page to clients that prefer HTML. Once it has been called, anything
+// else the handler writes to w is dropped.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := newProblem(r, err)
+	if problem.Status >= 500 {
+		Logger.Error("request failed", "request_id", problem.RequestID, "method", r.Method, "path", r.URL.Path, "err", err)
+	}
+	if gw := findGuard(w); gw != nil {
+		if gw.wroteHeader {
+			Logger.Warn("error after response started", "request_id", problem.RequestID, "method", r.Method, "path", r.URL.Path, "err", err)
+			gw.errSent = true
+			return
+		}
+		defer func() { gw.errSent = true }()
+	}
+	w.Header().Add("Vary", "Accept")
+	if prefersHTML(r) {
+		writeHTMLPage(w, problem.Status, fmt.Sprintf("%d %s", problem.Status, problem.Title),
+			fmt.Sprintf("%s\n\nrequest id: %s", problem.Detail, problem.RequestID))
+		return
+	}
+	b, _ := json.Marshal(problem)
+	w.Header().Set("Content-type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+// guardedWriter remembers whether the response has started and
+// swallows writes made after WriteError.
+type guardedWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	errSent     bool
+}
+
+func (w *guardedWriter) WriteHeader(status int) {
+	if w.errSent || w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *guardedWriter) Write(b []byte) (int, error) {
+	if w.errSent {
+		return len(b), nil
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *guardedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.errSent {
+		f.Flush()
+	}
+}
+
+func (w *guardedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// findGuard digs through wrapping response writers for the guardedWriter.
+func findGuard(w http.ResponseWriter) *guardedWriter {
+	for {
+		switch v := w.(type) {
+		case *guardedWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Recover guards the response writer for WriteError and turns
+// panics into 500 problem documents.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &guardedWriter{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				Logger.Error("panic", "request_id", RequestID(r), "method", r.Method, "path", r.URL.Path,
+					"panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+				WriteError(gw, r, fmt.Errorf("panic: %v", p))
+			}
+		}()
+		next.ServeHTTP(gw, r)
+	})
+}
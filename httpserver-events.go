@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events carries what happens on the server to /events streams:
+//
+//	user.created, user.updated  a user resource
+//	user.deleted                {"username": ...}
+//	users.reloaded              {"users": count}, after users.json changed
+//	config.reloaded             {"settings": [names]}, the settings that changed
+//
+// user.* and users.reloaded go only to clients of the sites that have the
+// users that changed.
+var Events *Hub
+
+// Event is one message of the hub. IDs only grow, also across restarts.
+type Event struct {
+	ID    uint64      `json:"-"`
+	Topic string      `json:"topic"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+	Site  string      `json:"site,omitempty"` // whose users; see Site.usersSite
+	local bool        // for the clients of Site's users only
+}
+
+// Hub fans events out to subscribers and keeps the latest few so that a
+// client that reconnects can pick up where it left off.
+type Hub struct {
+	mu     sync.Mutex
+	nextID uint64
+	replay []Event // oldest first
+	size   int
+	subs   map[*Subscription]bool
+	closed bool
+}
+
+// Subscription receives the events of some topics. C is closed when the
+// subscriber falls too far behind or the hub closes.
+type Subscription struct {
+	C      <-chan Event
+	c      chan Event
+	site   string
+	topics []string
+}
+
+// subscriptionBuffer is how many events a subscriber may lag behind
+// before it is dropped. It can resume from the replay buffer.
+const subscriptionBuffer = 64
+
+// NewHub keeps the last replay events for resuming clients.
+func NewHub(replay int) *Hub {
+	// starting from the clock keeps IDs from before a restart below new ones
+	return &Hub{nextID: uint64(time.Now().UnixNano()), size: replay, subs: make(map[*Subscription]bool)}
+}
+
+// wants reports whether topics (nil for all) take topic. "user" takes
+// user.created, user.updated and user.deleted as well as "user".
+func wants(topics []string, topic string) bool {
+	if len(topics) == 0 {
+		return true
+	}
+	for _, t := range topics {
+		if t == topic || strings.HasPrefix(topic, t+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends an event to every subscriber that wants it.
+func (h *Hub) Publish(topic string, data interface{}) {
+	h.publish(Event{Topic: topic, Data: data})
+}
+
+// PublishSite sends an event to the subscribers that want it on the
+// sites with the users of site.
+func (h *Hub) PublishSite(site, topic string, data interface{}) {
+	h.publish(Event{Topic: topic, Data: data, Site: site, local: true})
+}
+
+func (h *Hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.nextID++
+	e.ID, e.Time = h.nextID, time.Now().UTC()
+	if h.size > 0 {
+		if len(h.replay) == h.size {
+			copy(h.replay, h.replay[1:])
+			h.replay = h.replay[:h.size-1]
+		}
+		h.replay = append(h.replay, e)
+	}
+	for sub := range h.subs {
+		if !sub.wants(e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			Logger.Warn("dropping slow event subscriber", "topic", e.Topic)
+			h.drop(sub)
+		}
+	}
+}
+
+// Subscribe starts a subscription to topics for a client of a site with
+// the users of site. With lastID set, it also returns the events after
+// lastID still in the replay buffer, and complete is false if some of them
+// have already fallen out of it.
+func (h *Hub) Subscribe(site string, topics []string, lastID uint64) (sub *Subscription, missed []Event, complete bool) {
+	c := make(chan Event, subscriptionBuffer)
+	sub = &Subscription{C: c, c: c, site: site, topics: topics}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(c)
+		return sub, nil, true
+	}
+	h.subs[sub] = true
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	complete = lastID >= h.nextID || (len(h.replay) > 0 && h.replay[0].ID <= lastID+1)
+	for _, e := range h.replay {
+		if e.ID > lastID && sub.wants(e) {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, complete
+}
+
+func (sub *Subscription) wants(e Event) bool {
+	return (!e.local || e.Site == sub.site) && wants(sub.topics, e.Topic)
+}
+
+// Unsubscribe ends sub. It is safe to call more than once.
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(sub)
+}
+
+func (h *Hub) drop(sub *Subscription) {
+	if h.subs[sub] {
+		delete(h.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Closed reports whether Close has been called.
+func (h *Hub) Closed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// Close ends every subscription, so that streams let the server shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		h.drop(sub)
+	}
+}
+
+// EventsHandler streams the hub as Server-Sent Events:
+//
+//	GET /events?topics=user,config
+//
+// Each event goes out with its topic as the SSE event name and the Event
+// as JSON data. A client reconnecting with Last-Event-ID (EventSource does
+// this by itself) first gets what it missed; if some of that is no longer
+// kept it gets a "reset" event, and should reload whatever it shows.
+// A comment line goes out every events_heartbeat seconds. Only logged in
+// users may listen, and the stream ends when they log out.
+func EventsHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	if request.Method != "GET" {
+		response.Header().Set("Allow", "GET")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+	}
+	if CurrentUsername(request) == "" {
+		return nil, NewHTTPError(http.StatusUnauthorized, "log in to use %s", request.URL.Path).WithCode("not_logged_in")
+	}
+	sess := CurrentSession(request)
+	var topics []string
+	for _, t := range strings.Split(request.URL.Query().Get("topics"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			topics = append(topics, t)
+		}
+	}
+	var lastID uint64
+	if v := request.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, NewHTTPError(http.StatusBadRequest, "Last-Event-ID %q is not an event id", v)
+		}
+		lastID = id
+	}
+
+	sub, missed, complete := Events.Subscribe(SiteFor(request).usersSite(), topics, lastID)
+	defer Events.Unsubscribe(sub)
+
+	heartbeat := Config().EventsHeartbeat
+	rc := http.NewResponseController(response)
+	h := response.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	// the server's write_timeout would end the stream; push it out as we go
+	send := func(format string, args ...interface{}) error {
+		rc.SetWriteDeadline(time.Now().Add(heartbeat + 10*time.Second))
+		if _, err := fmt.Fprintf(response, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	sendEvent := func(e Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return send("id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Topic, data)
+	}
+
+	if err := send("retry: 3000\n\n"); err != nil {
+		return nil, nil
+	}
+	if !complete {
+		if err := send("event: reset\ndata: {}\n\n"); err != nil {
+			return nil, nil
+		}
+	}
+	for _, e := range missed {
+		if err := sendEvent(e); err != nil {
+			return nil, nil
+		}
+	}
+
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	recheck := time.NewTicker(sessionRecheck)
+	defer recheck.Stop()
+	for {
+		select {
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil, nil
+			}
+			if err := sendEvent(e); err != nil {
+				return nil, nil
+			}
+		case <-ticker.C:
+			if err := send(": ping\n\n"); err != nil {
+				return nil, nil
+			}
+		case <-recheck.C:
+			if sess = Sessions.Refresh(sess); sess == nil {
+				return nil, nil
+			}
+		case <-request.Context().Done():
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AppHandler is a handler that returns what it wants to send instead of
+// writing it. Errors are sent by WriteError; Views go through their
+// templates and other values are rendered as JSON or HTML depending on
+// the request's Accept header.
+//
+// A handler that writes the response itself returns (nil, nil).
+type AppHandler func(w http.ResponseWriter, r *http.Request) (interface{}, error)
+
+func (h AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v, err := h(w, r)
+	if err == nil {
+		v, err = renderView(v)
+	}
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	render(w, r, v)
+}
+
+// Result lets a handler pick a status other than 200 OK.
+type Result struct {
+	Status   int
+	Location string // sent as the Location header when set
+	Value    interface{}
+}
+
+func Created(location string, v interface{}) *Result {
+	return &Result{Status: http.StatusCreated, Location: location, Value: v}
+}
+
+var NoContent = &Result{Status: http.StatusNoContent}
+
+// HTML is a finished page; it is sent as is, whatever the client accepts.
+type HTML []byte
+
+// Adapt runs a plain http.Handler, such as http.FileServer, as an AppHandler.
+func Adapt(h http.Handler) AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		h.ServeHTTP(w, r)
+		return nil, nil
+	}
+}
+
+func render(w http.ResponseWriter, r *http.Request, v interface{}) {
+	status := http.StatusOK
+	if res, ok := v.(*Result); ok {
+		status, v = res.Status, res.Value
+		if res.Location != "" {
+			w.Header().Set("Location", res.Location)
+		}
+	}
+	switch body := v.(type) {
+	case nil:
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+	case HTML:
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write(body)
+	default:
+		w.Header().Add("Vary", "Accept")
+		if prefersHTML(r) {
+			b, _ := json.MarshalIndent(body, "", "  ")
+			writeHTMLPage(w, status, r.URL.Path, string(b))
+			return
+		}
+		writeJSON(w, status, body)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(w, "%s\n", b)
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset='utf-8'>
+  <title>{{.Title}}</title>
+</head>
+<body>
+  <h1>{{.Title}}</h1>
+  <pre>{{.Body}}</pre>
+</body>
+</html>
+`))
+
+func writeHTMLPage(w http.ResponseWriter, status int, title, body string) {
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	pageTemplate.Execute(w, struct{ Title, Body string }{title, body})
+}
+
+// prefersHTML reports whether the client ranks text/html above
+// application/json in its Accept header. Without a preference we send JSON.
+func prefersHTML(r *http.Request) bool {
+	return acceptQuality(r, "text/html") > acceptQuality(r, "application/json")
+}
+
+// acceptQuality returns the q value the Accept header gives mediaType,
+// using the most specific matching range.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		s := -1
+		switch {
+		case mt == mediaType:
+			s = 2
+		case mt == "*/*":
+			s = 0
+		case strings.HasSuffix(mt, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mt, "*")):
+			s = 1
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+	}
+	return q
+}
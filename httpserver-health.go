@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds each readiness check so a stuck dependency
+// fails the probe instead of hanging it.
+const checkTimeout = 2 * time.Second
+
+// healthCheck is one named probe; it passes when fn returns nil.
+type healthCheck struct {
+	name string
+	fn   func() error
+}
+
+// checkResult is how a check is reported in the JSON body.
+type checkResult struct {
+	Status     string  `json:"status"` // "ok" or "fail"
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status        string                 `json:"status"`
+	UptimeSeconds float64                `json:"uptime_seconds"`
+	Checks        map[string]checkResult `json:"checks"`
+}
+
+// Health serves the liveness, readiness and version endpoints.
+// Liveness only shows the process can answer; readiness runs the checks
+// and answers 503 Service Unavailable when any of them fails.
+type Health struct {
+	started time.Time
+	checks  []healthCheck
+}
+
+func NewHealth() *Health {
+	return &Health{started: time.Now()}
+}
+
+// AddCheck registers a readiness check.
+func (h *Health) AddCheck(name string, fn func() error) {
+	h.checks = append(h.checks, healthCheck{name, fn})
+}
+
+// LiveHandler serves /healthz.
+func (h *Health) LiveHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	return h.report(nil), nil
+}
+
+// ReadyHandler serves /readyz.
+func (h *Health) ReadyHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	report := h.report(h.checks)
+	if report.Status != "ok" {
+		return &Result{Status: http.StatusServiceUnavailable, Value: report}, nil
+	}
+	return report, nil
+}
+
+// report runs checks concurrently and collects their results.
+func (h *Health) report(checks []healthCheck) *healthReport {
+	report := &healthReport{
+		Status:        "ok",
+		UptimeSeconds: time.Since(h.started).Seconds(),
+		Checks:        make(map[string]checkResult, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c healthCheck) {
+			defer wg.Done()
+			result := runCheck(c)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if result.Status != "ok" {
+				report.Status = "fail"
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+func runCheck(c healthCheck) checkResult {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- c.fn() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(checkTimeout):
+		err = fmt.Errorf("timed out after %v", checkTimeout)
+	}
+	result := checkResult{Status: "ok", DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Error = "fail", err.Error()
+		Logger.Warn("readiness check failed", "check", c.name, "err", err)
+	}
+	return result
+}
+
+// dirReadable checks that dir exists, is a directory and can be listed.
+func dirReadable(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if _, err := f.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+type versionInfo struct {
+	GoVersion string            `json:"go_version"`
+	Path      string            `json:"path,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Settings  map[string]string `json:"settings,omitempty"`
+	Deps      map[string]string `json:"deps,omitempty"`
+}
+
+// VersionHandler serves /version from the build info compiled into the binary.
+func VersionHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil, NewHTTPError(http.StatusNotImplemented, "no build info in this binary")
+	}
+	v := versionInfo{
+		GoVersion: info.GoVersion,
+		Path:      info.Main.Path,
+		Version:   info.Main.Version,
+		Settings:  make(map[string]string),
+		Deps:      make(map[string]string),
+	}
+	for _, s := range info.Settings {
+		// the compiler flags and environment are nobody's business
+		if strings.HasPrefix(s.Key, "vcs.") || s.Key == "GOOS" || s.Key == "GOARCH" || s.Key == "-tags" {
+			v.Settings[s.Key] = s.Value
+		}
+	}
+	for _, dep := range info.Deps {
+		v.Deps[dep.Path] = dep.Version
+	}
+	return v, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server is an http.Server that stops gracefully on SIGINT or SIGTERM:
+// it stops accepting connections, waits up to ShutdownTimeout for
+// in-flight requests, then runs the shutdown hooks, newest first.
+type Server struct {
+	*http.Server
+	ShutdownTimeout time.Duration
+
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func NewServer(settings *Settings, addr string, handler http.Handler) *Server {
+	return &Server{
+		Server: &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadTimeout:       settings.ReadTimeout,
+			ReadHeaderTimeout: settings.ReadHeaderTimeout,
+			WriteTimeout:      settings.WriteTimeout,
+			IdleTimeout:       settings.IdleTimeout,
+		},
+		ShutdownTimeout: settings.ShutdownTimeout,
+	}
+}
+
+// OnShutdown registers fn to run after the server has stopped serving.
+func (s *Server) OnShutdown(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name, fn})
+}
+
+// Closer adapts a Close method to a shutdown hook.
+func Closer(close func() error) func(context.Context) error {
+	return func(context.Context) error { return close() }
+}
+
+// Run serves until a signal arrives or serve fails, then shuts down.
+// serve is normally s.ListenAndServe.
+func (s *Server) Run(serve func() error) error {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve() }()
+
+	var err error
+	select {
+	case sig := <-stop:
+		Logger.Info("shutting down", "signal", sig.String(), "timeout", s.ShutdownTimeout)
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := s.Shutdown(ctx); shutdownErr != nil {
+		Logger.Warn("closing remaining connections", "err", shutdownErr)
+		s.Close()
+	}
+	s.runHooks(ctx)
+	return err
+}
+
+func (s *Server) runHooks(ctx context.Context) {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			Logger.Error("shutdown hook failed", "hook", hooks[i].name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const minPasswordLength = 8
+
+var ErrLockedOut = errors.New("too many failed login attempts")
+
+// dummyHash is compared against when the user does not exist, so that
+// unknown usernames take as long to reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// SetPassword stores a bcrypt hash of password on u.
+func (u *User) SetPassword(password string, cost int) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// Lockout counts failed logins per username. After MaxAttempts failures
+// within Window the username is locked until Window has passed since the
+// last failure.
+type Lockout struct {
+	MaxAttempts int
+	Window      time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+func NewLockout(maxAttempts int, window time.Duration) *Lockout {
+	return &Lockout{MaxAttempts: maxAttempts, Window: window, failures: make(map[string]*loginFailures)}
+}
+
+// Check returns how long username stays locked, or 0.
+func (l *Lockout) Check(username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.failures[username]
+	if !ok {
+		return 0
+	}
+	left := l.Window - time.Since(f.last)
+	if left <= 0 {
+		delete(l.failures, username)
+		return 0
+	}
+	if f.count < l.MaxAttempts {
+		return 0
+	}
+	return left
+}
+
+func (l *Lockout) Fail(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.failures) > 10000 {
+		for name, f := range l.failures {
+			if time.Since(f.last) > l.Window {
+				delete(l.failures, name)
+			}
+		}
+	}
+	f, ok := l.failures[username]
+	if !ok || time.Since(f.last) > l.Window {
+		f = &loginFailures{}
+		l.failures[username] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+func (l *Lockout) Succeed(username string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, username)
+}
+
+// Authenticator checks usernames and passwords against the user store.
+type Authenticator struct {
+	Lockout *Lockout
+	// Passwordless lets users without a password_hash log in with just
+	// their username, as the debug form always has.
+	Passwordless bool
+}
+
+func NewAuthenticator(s *Settings) *Authenticator {
+	return &Authenticator{
+		Lockout:      NewLockout(s.LoginMaxAttempts, s.LoginLockout),
+		Passwordless: s.PasswordlessLogin,
+	}
+}
+
+// Authenticate returns the user of site if password is right. Every failure
+// looks the same to the caller except a lockout, which is an *HTTPError (429).
+func (a *Authenticator) Authenticate(site *Site, username, password string) (*User, error) {
+	failed := NewHTTPError(http.StatusUnauthorized, "invalid username or password").WithCode("login_failed")
+	// sites with their own users lock theirs out on their own
+	lockoutKey := username
+	if site.store != nil {
+		lockoutKey = site.usersSite() + " " + username
+	}
+	if left := a.Lockout.Check(lockoutKey); left > 0 {
+		return nil, &lockedOut{NewHTTPError(http.StatusTooManyRequests, "%v", ErrLockedOut).WithCode("locked_out"), left}
+	}
+	user, err := site.Users().Lookup(username)
+	if err != nil && err != ErrUserNotFound {
+		return nil, err
+	}
+	switch {
+	case user == nil:
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	case user.PasswordHash == "":
+		if a.Passwordless {
+			return user, nil
+		}
+	case bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil:
+		a.Lockout.Succeed(lockoutKey)
+		return user, nil
+	}
+	a.Lockout.Fail(lockoutKey)
+	return nil, failed
+}
+
+// lockedOut is a 429 that also says when to try again.
+type lockedOut struct {
+	*HTTPError
+	retryAfter time.Duration
+}
+
+func (e *lockedOut) Unwrap() error { return e.HTTPError }
+
+type LoginView struct {
+	Page
+	Next string // where to go after logging in
+}
+
+func (LoginView) Template() string { return "login.html" }
+
+type loginInput struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Next     string `json:"-"`
+	form     bool
+}
+
+// LoginHandler shows the login form (GET) or checks a username and
+// password (POST, as a form or as JSON) and starts a session.
+// Form posts are redirected to the next field, JSON posts get the user back.
+func LoginHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	switch request.Method {
+	case "GET", "HEAD":
+		return LoginView{Page: newPage(request, "Log in"), Next: safeNext(request.URL.Query().Get("next"))}, nil
+	case "POST":
+	default:
+		response.Header().Set("Allow", "GET, HEAD, POST")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+	}
+
+	in, err := readLoginInput(request)
+	if err != nil {
+		return nil, err
+	}
+	user, err := Auth.Authenticate(SiteFor(request), in.Username, in.Password)
+	var lo *lockedOut
+	if errors.As(err, &lo) {
+		response.Header().Set("Retry-After", strconv.Itoa(int(lo.retryAfter.Seconds())+1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Sessions.Login(response, request, user.Username); err != nil {
+		return nil, err
+	}
+	if in.form {
+		http.Redirect(response, request, safeNext(in.Next), http.StatusSeeOther)
+		return nil, nil
+	}
+	return newUserResource(user), nil
+}
+
+func readLoginInput(request *http.Request) (*loginInput, error) {
+	var in loginInput
+	if strings.HasPrefix(request.Header.Get("Content-type"), "application/json") {
+		if err := json.NewDecoder(request.Body).Decode(&in); err != nil {
+			return nil, badRequestBody(err, "invalid JSON body: %v", err)
+		}
+		return &in, nil
+	}
+	if err := request.ParseForm(); err != nil {
+		return nil, badRequestBody(err, "error parsing form %v", err)
+	}
+	in.Username = request.PostForm.Get("username")
+	in.Password = request.PostForm.Get("password")
+	in.Next = request.PostForm.Get("next")
+	in.form = true
+	return &in, nil
+}
+
+// safeNext only allows local paths as redirect targets after login.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/ajax"
+	}
+	return next
+}
+
+// runPasswd implements the passwd subcommand:
+//
+//	go run httpserver*.go passwd [flags] <username> [site]
+//
+// It reads the new password from the first line of standard input and
+// saves its hash in the configured user store, or in that of site (a key
+// of the sites section) if it has its own users.
+func runPasswd(args []string) error {
+	settings, err := LoadSettings(args)
+	if err != nil {
+		return err
+	}
+	if len(settings.Args) < 1 || len(settings.Args) > 2 {
+		return errors.New("usage: httpserver passwd [flags] <username> [site]")
+	}
+	kind, usersPath, storePath := settings.UserStore, settings.UsersPath, settings.UserStorePath
+	if len(settings.Args) == 2 {
+		site, ok := settings.Sites[settings.Args[1]]
+		if !ok {
+			return fmt.Errorf("%s is not in sites", settings.Args[1])
+		}
+		if site.UsersPath != "" {
+			kind, usersPath, storePath = site.UserStore, site.UsersPath, site.UserStorePath
+		}
+	}
+	if kind == "memory" {
+		// the change would be gone when passwd exits
+		return fmt.Errorf("the memory user store saves nothing; use the file or disk store, or edit %s", usersPath)
+	}
+	store, err := OpenUserStore(kind, usersPath, storePath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	user, err := store.Lookup(settings.Args[0])
+	if err != nil {
+		return fmt.Errorf("%s: %v", settings.Args[0], err)
+	}
+
+	fmt.Fprintf(os.Stderr, "New password for %s: ", user.Username)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return err
+	}
+	if err := user.SetPassword(strings.TrimRight(line, "\r\n"), settings.PasswordCost); err != nil {
+		return err
+	}
+	if err := store.Update(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "\nPassword updated for %s\n", user.Username)
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request
+// duration histogram (the Prometheus client defaults).
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// routeKey labels a request by the mux pattern that served it, or "rule
+// <name>" for one a rule redirected, and the class of its status code
+// ("2xx", "4xx", ...).
+type routeKey struct {
+	route  string
+	status string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// Metrics counts requests by route and status class and serves them,
+// with a few Go runtime figures, in the Prometheus text format.
+type Metrics struct {
+	mux     *http.ServeMux
+	started time.Time
+
+	inFlight int64
+
+	mu        sync.Mutex
+	requests  map[routeKey]uint64
+	durations map[routeKey]*histogram
+}
+
+// NewMetrics labels requests with the patterns registered on mux.
+func NewMetrics(mux *http.ServeMux) *Metrics {
+	return &Metrics{
+		mux:       mux,
+		started:   time.Now(),
+		requests:  make(map[routeKey]uint64),
+		durations: make(map[routeKey]*histogram),
+	}
+}
+
+// routeNote is how the middleware after Metrics tells it what became of
+// a request: a rule redirected it, or rewrote it to another route.
+type routeNote struct {
+	label   string        // e.g. "rule redirect", for requests that never reach the mux
+	request *http.Request // the request as rewritten
+}
+
+const routeNoteKey contextKey = "route-note"
+
+// noteRedirect labels r, in the metrics, by the rule that redirected it.
+func noteRedirect(r *http.Request, rule string) {
+	if note, ok := r.Context().Value(routeNoteKey).(*routeNote); ok {
+		note.label = "rule " + rule
+	}
+}
+
+// noteRewrite has the metrics count r under the route it was rewritten to.
+func noteRewrite(r *http.Request) {
+	if note, ok := r.Context().Value(routeNoteKey).(*routeNote); ok {
+		note.request = r
+	}
+}
+
+// Middleware records every request that passes through it, under the
+// route that served it after any rewrite.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&m.inFlight, 1)
+		defer atomic.AddInt64(&m.inFlight, -1)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		note := &routeNote{request: r}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeNoteKey, note)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := note.label
+		if route == "" {
+			_, route = m.mux.Handler(note.request)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		m.observe(routeKey{route, fmt.Sprintf("%dxx", rec.status/100)}, time.Since(start).Seconds())
+	})
+}
+
+func (m *Metrics) observe(key routeKey, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[key]++
+	h, ok := m.durations[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.durations[key] = h
+	}
+	h.observe(seconds)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	keys := make([]routeKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	fmt.Fprintln(w, "# HELP http_requests_total Requests served, by route pattern and status class.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "http_requests_total{%s} %d\n", key.labels(), m.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds Time taken to serve requests, by route pattern and status class.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, key := range keys {
+		h := m.durations[key]
+		labels := key.labels()
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, cumulative)
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_requests_in_flight Requests being served right now.")
+	fmt.Fprintln(w, "# TYPE http_requests_in_flight gauge")
+	fmt.Fprintf(w, "http_requests_in_flight %d\n", atomic.LoadInt64(&m.inFlight))
+
+	writeRuntimeMetrics(w, m.started)
+}
+
+func (key routeKey) labels() string {
+	return fmt.Sprintf(`route="%s",status="%s"`, labelEscaper.Replace(key.route), key.status)
+}
+
+// labelEscaper escapes label values the way the text format wants,
+// which is not quite Go's %q.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeRuntimeMetrics(w io.Writer, started time.Time) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	gauge := func(name, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %v\n", name, help, name, name, value)
+	}
+
+	fmt.Fprintf(w, "# HELP go_info Go version the server was built with.\n# TYPE go_info gauge\ngo_info{version=\"%s\"} 1\n", runtime.Version())
+	gauge("go_goroutines", "Goroutines that currently exist.", runtime.NumGoroutine())
+	gauge("go_memstats_alloc_bytes", "Bytes of allocated heap objects.", ms.HeapAlloc)
+	gauge("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", ms.HeapInuse)
+	gauge("go_memstats_heap_objects", "Allocated heap objects.", ms.HeapObjects)
+	gauge("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", ms.Sys)
+	counter("go_memstats_alloc_bytes_total", "Bytes allocated for heap objects, including freed ones.", ms.TotalAlloc)
+	counter("go_memstats_mallocs_total", "Heap objects allocated.", ms.Mallocs)
+	counter("go_gc_cycles_total", "Completed GC cycles.", ms.NumGC)
+	counter("go_gc_pause_seconds_total", "Time spent in GC stop-the-world pauses.", float64(ms.PauseTotalNs)/1e9)
+	gauge("process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", started.Unix())
+}
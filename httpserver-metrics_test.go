@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsScrape(t *testing.T) {
+	srv := startTestServer(t, func(s *Settings) {
+		s.Rules = map[string]RuleSettings{
+			"redirect": defaultRules["redirect"],
+			"short":    {Match: "regex", Path: "^/u/(\\w+)$", To: "/user/$1", Rewrite: true},
+		}
+	})
+	c := newTestClient(t, srv)
+
+	for path, want := range map[string]int{
+		"/me":           http.StatusUnauthorized,
+		"/redirect":     http.StatusTemporaryRedirect,
+		"/u/joesample":  http.StatusOK,
+		"/user/nobody":  http.StatusNotFound,
+		"/missing.html": http.StatusNotFound,
+	} {
+		if resp, body := c.do("GET", path, nil); resp.StatusCode != want {
+			t.Fatalf("GET %s: got %s %s, want %d", path, resp.Status, body, want)
+		}
+	}
+
+	resp, body := c.do("GET", "/metrics", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics: %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q is not the Prometheus text format", ct)
+	}
+	scrape := string(body)
+	for _, want := range []string{
+		`http_requests_total{route="/me",status="4xx"} 1`,
+		`http_requests_total{route="rule redirect",status="3xx"} 1`,
+		// rewritten from /u/joesample
+		`http_requests_total{route="/user/",status="2xx"} 1`,
+		`http_requests_total{route="/user/",status="4xx"} 1`,
+		`http_requests_total{route="/",status="4xx"} 1`,
+		`http_request_duration_seconds_count{route="/me",status="4xx"} 1`,
+		`http_request_duration_seconds_bucket{route="/me",status="4xx",le="+Inf"} 1`,
+		"# TYPE http_request_duration_seconds histogram",
+		// the scrape itself
+		"http_requests_in_flight 1",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(scrape, want) {
+			t.Errorf("scrape lacks %q:\n%s", want, scrape)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logger is the server's leveled, structured logger. It writes text
+// until NewLogger replaces it with the configured format.
+var Logger = slog.Default()
+
+// logLevel is shared by every logger NewLogger makes, so that a config
+// reload can change the level while the server runs.
+var logLevel = new(slog.LevelVar)
+
+// NewLogger builds a logger writing logfmt ("logfmt") or JSON ("json")
+// lines to stderr, dropping anything below the level set by SetLogLevel.
+func NewLogger(format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "logfmt":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("log_format: %q is not one of logfmt or json", format)
+}
+
+// SetLogLevel sets the level (debug, info, warn or error) of every logger.
+func SetLogLevel(level string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(lvl)
+	return nil
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("log_level: %q is not one of debug, info, warn or error", level)
+	}
+	return lvl, nil
+}
+
+// Middleware wraps a handler with behaviour shared by every route.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h so that a request passes through middlewares in the order given.
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+type contextKey string
+
+const requestIDKey contextKey = "request-id"
+
+// RequestID returns the ID RequestIDs gave the request.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestIDs tags each request with an ID, reusing the client's
+// X-Request-ID when it sent a sensible one, and echoes it in the response.
+func RequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 || strings.ContainsAny(id, " \t\r\n\"") {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// logEntry collects what the access log line needs to know about a
+// request from handlers further down the chain.
+type logEntry struct {
+	user string
+}
+
+const logEntryKey contextKey = "log-entry"
+
+// SetLogUser records who made the request for the access log.
+func SetLogUser(r *http.Request, username string) {
+	if e, ok := r.Context().Value(logEntryKey).(*logEntry); ok {
+		e.user = username
+	}
+}
+
+// statusRecorder remembers the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack logs a connection taken over for WebSocket as 101 Switching Protocols.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AccessLog writes one line per request once it has been served.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &logEntry{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), logEntryKey, entry)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		Logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", RequestID(r)),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("user", entry.user),
+			slog.String("remote", r.RemoteAddr),
+		)
+	})
+}
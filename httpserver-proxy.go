@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxyRoute is one entry of the proxies section of the config file,
+// which maps a path prefix such as "/api/" to the services behind it.
+type ProxyRoute struct {
+	Upstreams      []UpstreamSettings
+	Balance        string        // "round_robin" or "least_conn"
+	StripPrefix    bool          // send /api/users upstream as /users
+	Timeout        time.Duration // for upstreams that set no timeout of their own
+	ConnectTimeout time.Duration
+	Retries        int  // further upstreams to try for idempotent requests
+	ForwardCookies bool // pass this server's session and CSRF cookies on too
+
+	HealthPath     string // polled on every upstream; "" for no checks
+	HealthInterval time.Duration
+
+	RequestHeaders  map[string]string // set on the way in; "" removes
+	ResponseHeaders map[string]string // set on the way out; "" removes
+}
+
+// UpstreamSettings is one of the upstreams of a ProxyRoute.
+type UpstreamSettings struct {
+	URL     string        // base URL, e.g. "http://10.0.0.5:9000"
+	Timeout time.Duration // for its response headers; 0 for the route's
+}
+
+// Proxy forwards the requests of one route to its upstreams.
+type Proxy struct {
+	prefix    string
+	route     ProxyRoute
+	upstreams []*upstream
+	next      atomic.Uint64 // round robin position
+	handler   *httputil.ReverseProxy
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type upstream struct {
+	url       *url.URL
+	timeout   time.Duration
+	transport *http.Transport // with the upstream's timeout
+	active    atomic.Int64    // requests in flight
+	healthy   atomic.Bool
+}
+
+// errNoUpstream is what a route with every upstream tried or down fails with.
+var errNoUpstream = errors.New("no upstream available")
+
+// NewProxy checks route and sets up its transport. Health checks start
+// with Start.
+func NewProxy(prefix string, route ProxyRoute) (*Proxy, error) {
+	if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return nil, fmt.Errorf("proxies: %q is not a path prefix like \"/api/\"", prefix)
+	}
+	if len(route.Upstreams) == 0 {
+		return nil, fmt.Errorf("proxies: %s: no upstreams", prefix)
+	}
+	switch route.Balance {
+	case "round_robin", "least_conn":
+	default:
+		return nil, fmt.Errorf("proxies: %s: balance %q is not one of round_robin or least_conn", prefix, route.Balance)
+	}
+	if route.Retries < 0 {
+		return nil, fmt.Errorf("proxies: %s: retries must not be negative", prefix)
+	}
+	if route.HealthPath != "" && (!strings.HasPrefix(route.HealthPath, "/") || route.HealthInterval <= 0) {
+		return nil, fmt.Errorf("proxies: %s: health_path must be a path and health_interval positive", prefix)
+	}
+	p := &Proxy{prefix: prefix, route: route, stop: make(chan struct{})}
+	for _, settings := range route.Upstreams {
+		u, err := url.Parse(settings.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("proxies: %s: %q is not an http or https URL without a query", prefix, settings.URL)
+		}
+		if settings.Timeout < 0 {
+			return nil, fmt.Errorf("proxies: %s: %s: timeout must not be negative", prefix, settings.URL)
+		}
+		up := &upstream{url: u, timeout: settings.Timeout}
+		if up.timeout == 0 {
+			up.timeout = route.Timeout
+		}
+		up.transport = &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: route.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			ResponseHeaderTimeout: up.timeout,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			ForceAttemptHTTP2:     true,
+		}
+		up.healthy.Store(true)
+		p.upstreams = append(p.upstreams, up)
+	}
+
+	p.handler = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      roundTripFunc(p.roundTrip),
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+	}
+	return p, nil
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// rewrite readies the outgoing request; roundTrip points it at an upstream.
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	pr.SetXForwarded()
+	if p.route.StripPrefix {
+		pr.Out.URL.Path = "/" + strings.TrimPrefix(pr.In.URL.Path, p.prefix)
+		pr.Out.URL.RawPath = ""
+	}
+	if !p.route.ForwardCookies {
+		stripOwnCookies(pr.Out)
+	}
+	for name, value := range p.route.RequestHeaders {
+		if value == "" {
+			pr.Out.Header.Del(name)
+		} else {
+			pr.Out.Header.Set(name, value)
+		}
+	}
+}
+
+// stripOwnCookies removes this server's session and CSRF cookies from r,
+// which upstreams could otherwise use to act as the user here. The
+// upstreams' own cookies pass.
+func stripOwnCookies(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != Sessions.CookieName && c.Name != csrfCookie {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	for name, value := range p.route.ResponseHeaders {
+		if value == "" {
+			resp.Header.Del(name)
+		} else {
+			resp.Header.Set(name, value)
+		}
+	}
+	return nil
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		// the client went away; nobody is listening for an answer
+		return
+	case errors.Is(err, errNoUpstream):
+		WriteError(w, r, NewHTTPError(http.StatusServiceUnavailable, "%s: %v", p.prefix, err).WithCode("upstream_unavailable"))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		WriteError(w, r, NewHTTPError(http.StatusGatewayTimeout, "%s: upstream timed out", p.prefix).WithCode("upstream_timeout"))
+	default:
+		Logger.Warn("proxy error", "request_id", RequestID(r), "route", p.prefix, "err", err)
+		WriteError(w, r, NewHTTPError(http.StatusBadGateway, "%s: upstream failed", p.prefix).WithCode("bad_gateway"))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// roundTrip sends req to an upstream picked by the route's balancing and,
+// for an idempotent request without a body, to others when one fails
+// without answering, up to Retries more times. Timeouts are not retried.
+func (p *Proxy) roundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*upstream]bool)
+	for attempt := 0; ; attempt++ {
+		up := p.pick(tried)
+		if up == nil {
+			return nil, errNoUpstream
+		}
+		tried[up] = true
+
+		out := req.Clone(req.Context())
+		out.URL.Scheme = up.url.Scheme
+		out.URL.Host = up.url.Host
+		out.URL.Path = strings.TrimSuffix(up.url.Path, "/") + req.URL.Path
+		out.URL.RawPath = ""
+		out.Host = ""
+
+		up.active.Add(1)
+		resp, err := up.transport.RoundTrip(out)
+		if err != nil {
+			up.active.Add(-1)
+			var netErr net.Error
+			if req.Context().Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+				// a slow answer is no reason to ask another upstream
+				return nil, err
+			}
+			var opErr *net.OpError
+			if p.route.HealthPath != "" && errors.As(err, &opErr) && opErr.Op == "dial" {
+				// leave it to the next health check to bring it back
+				p.setHealthy(up, err)
+			}
+			if attempt < p.route.Retries && retryable(req) {
+				Logger.Debug("proxy retry", "request_id", RequestID(req), "route", p.prefix, "upstream", up.url.Host, "err", err)
+				continue
+			}
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// the connection now belongs to the client, e.g. a WebSocket
+			up.active.Add(-1)
+			return resp, nil
+		}
+		resp.Body = &upstreamBody{ReadCloser: resp.Body, up: up}
+		return resp, nil
+	}
+}
+
+// upstreamBody counts a request as in flight until its response is read.
+type upstreamBody struct {
+	io.ReadCloser
+	up   *upstream
+	once sync.Once
+}
+
+func (b *upstreamBody) Close() error {
+	b.once.Do(func() { b.up.active.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// retryable reports whether req can be sent again: its method is
+// idempotent, or it carries an Idempotency-Key, and there is no body to
+// have been used up.
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+// pick chooses among the healthy upstreams not yet tried, or among all
+// untried ones when none is healthy: a failed health check may be stale.
+func (p *Proxy) pick(tried map[*upstream]bool) *upstream {
+	var candidates []*upstream
+	for _, healthyOnly := range []bool{true, false} {
+		for _, up := range p.upstreams {
+			if !tried[up] && (!healthyOnly || up.healthy.Load()) {
+				candidates = append(candidates, up)
+			}
+		}
+		if len(candidates) > 0 {
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := int(p.next.Add(1) % uint64(len(candidates)))
+	if p.route.Balance == "round_robin" {
+		return candidates[start]
+	}
+	// least_conn, ties going round robin
+	var best *upstream
+	for i := range candidates {
+		up := candidates[(start+i)%len(candidates)]
+		if best == nil || up.active.Load() < best.active.Load() {
+			best = up
+		}
+	}
+	return best
+}
+
+// Start polls HealthPath on every upstream each HealthInterval, taking
+// an upstream out of rotation while it fails, until Stop.
+func (p *Proxy) Start() {
+	if p.route.HealthPath == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(p.route.HealthInterval)
+		defer ticker.Stop()
+		for {
+			var wg sync.WaitGroup
+			for _, up := range p.upstreams {
+				wg.Add(1)
+				go func(up *upstream) {
+					defer wg.Done()
+					p.setHealthy(up, p.checkHealth(up))
+				}(up)
+			}
+			wg.Wait()
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (p *Proxy) checkHealth(up *upstream) error {
+	client := &http.Client{
+		Transport: up.transport,
+		Timeout:   up.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	target := *up.url
+	target.Path = strings.TrimSuffix(up.url.Path, "/") + p.route.HealthPath
+	resp, err := client.Get(target.String())
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// setHealthy records the result of a health check, or a failure seen
+// while proxying, and logs the upstream going up or down.
+func (p *Proxy) setHealthy(up *upstream, err error) {
+	healthy := err == nil
+	if up.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		Logger.Info("upstream healthy", "route", p.prefix, "upstream", up.url.String())
+	} else {
+		Logger.Warn("upstream down", "route", p.prefix, "upstream", up.url.String(), "err", err)
+	}
+}
+
+// Stop ends the health checks.
+func (p *Proxy) Stop() error {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		for _, up := range p.upstreams {
+			up.transport.CloseIdleConnections()
+		}
+	})
+	return nil
+}
+
+// MountProxies adds a handler to mux for every route in proxies. A route
+// that is already taken, such as "/user/", is an error.
+func MountProxies(mux *http.ServeMux, proxies map[string]ProxyRoute) ([]*Proxy, error) {
+	var prefixes []string
+	for prefix := range proxies {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	var mounted []*Proxy
+	for _, prefix := range prefixes {
+		p, err := NewProxy(prefix, proxies[prefix])
+		if err != nil {
+			return nil, err
+		}
+		if _, pattern := mux.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: prefix}}); pattern == prefix {
+			return nil, fmt.Errorf("proxies: %s is already a route of this server", prefix)
+		}
+		mux.Handle(prefix, Adapt(p))
+		mounted = append(mounted, p)
+	}
+	return mounted, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newUpstream starts a service that says who it is in X-Upstream and
+// hands the rest to handle, if not nil.
+func newUpstream(t *testing.T, name string, handle http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		if handle != nil {
+			handle(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// proxyRoute is an /api/ route to upstreams with the config file's defaults.
+func proxyRoute(balance string, upstreams ...string) ProxyRoute {
+	route := ProxyRoute{
+		Balance:        balance,
+		StripPrefix:    true,
+		Timeout:        10 * time.Second,
+		ConnectTimeout: time.Second,
+		Retries:        1,
+	}
+	for _, u := range upstreams {
+		route.Upstreams = append(route.Upstreams, UpstreamSettings{URL: u})
+	}
+	return route
+}
+
+func withProxy(route ProxyRoute) func(*Settings) {
+	return func(s *Settings) { s.Proxies = map[string]ProxyRoute{"/api/": route} }
+}
+
+// hits sends n requests and returns which upstream answered each.
+func hits(c *testClient, method, path string, n int) []string {
+	c.t.Helper()
+	var names []string
+	for i := 0; i < n; i++ {
+		var body interface{}
+		if method == "POST" {
+			body = map[string]int{"n": i}
+		}
+		resp, b := c.do(method, path, body)
+		if resp.StatusCode != http.StatusOK {
+			c.t.Fatalf("%s %s: %s %s", method, path, resp.Status, b)
+		}
+		names = append(names, resp.Header.Get("X-Upstream"))
+	}
+	return names
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a, b, c := newUpstream(t, "a", nil), newUpstream(t, "b", nil), newUpstream(t, "c", nil)
+	srv := startTestServer(t, withProxy(proxyRoute("round_robin", a.URL, b.URL, c.URL)))
+	client := newTestClient(t, srv)
+
+	names := hits(client, "GET", "/api/things", 6)
+	for i := 3; i < len(names); i++ {
+		if names[i] != names[i-3] {
+			t.Fatalf("not in turn: %v", names)
+		}
+	}
+	if seen := strings.Join(names[:3], ""); !strings.Contains(seen, "a") || !strings.Contains(seen, "b") || !strings.Contains(seen, "c") {
+		t.Fatalf("not every upstream in a round: %v", names)
+	}
+}
+
+func TestProxyLeastConn(t *testing.T) {
+	release := make(chan struct{})
+	busy := make(chan string, 1)
+	handle := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				busy <- name
+				<-release
+			}
+		}
+	}
+	a, b := newUpstream(t, "a", handle("a")), newUpstream(t, "b", handle("b"))
+	srv := startTestServer(t, withProxy(proxyRoute("least_conn", a.URL, b.URL)))
+	client := newTestClient(t, srv)
+
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		resp, err := http.Get(srv.URL + "/api/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	held := <-busy
+	for _, name := range hits(client, "GET", "/api/fast", 4) {
+		if name == held {
+			t.Errorf("%s got a request while busy and the other was idle", name)
+		}
+	}
+	close(release)
+	<-slow
+}
+
+func TestProxyHealthCheck(t *testing.T) {
+	var bDown atomic.Bool
+	bDown.Store(true)
+	a := newUpstream(t, "a", nil)
+	b := newUpstream(t, "b", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && bDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	route := proxyRoute("round_robin", a.URL, b.URL)
+	route.HealthPath = "/healthz"
+	route.HealthInterval = 20 * time.Millisecond
+	srv := startTestServer(t, withProxy(route))
+	client := newTestClient(t, srv)
+
+	// the first check runs as the proxy starts
+	waitFor(t, "b to be ejected", func() bool {
+		return !strings.Contains(strings.Join(hits(client, "GET", "/api/x", 4), ""), "b")
+	})
+	bDown.Store(false)
+	waitFor(t, "b to come back", func() bool {
+		return strings.Contains(strings.Join(hits(client, "GET", "/api/x", 4), ""), "b")
+	})
+}
+
+func TestProxyRetries(t *testing.T) {
+	// an upstream that refuses connections
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	live := newUpstream(t, "live", nil)
+	srv := startTestServer(t, withProxy(proxyRoute("round_robin", dead.URL, live.URL)))
+	client := newTestClient(t, srv)
+
+	for _, name := range hits(client, "GET", "/api/x", 4) {
+		if name != "live" {
+			t.Errorf("GET answered by %q", name)
+		}
+	}
+
+	statuses := map[int]int{}
+	for i := 0; i < 4; i++ {
+		resp, _ := client.do("POST", "/api/x", map[string]int{"n": i})
+		statuses[resp.StatusCode]++
+	}
+	if statuses[http.StatusOK] != 2 || statuses[http.StatusBadGateway] != 2 {
+		t.Errorf("POSTs were retried, or not sent in turn: %v", statuses)
+	}
+}
+
+func TestProxyTimeout(t *testing.T) {
+	slowly := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}
+	impatient, patient := newUpstream(t, "impatient", slowly), newUpstream(t, "patient", slowly)
+	route := proxyRoute("round_robin", impatient.URL, patient.URL)
+	route.Upstreams[0].Timeout = 50 * time.Millisecond
+	srv := startTestServer(t, withProxy(route))
+	client := newTestClient(t, srv)
+
+	statuses := map[int]int{}
+	for i := 0; i < 2; i++ {
+		resp, body := client.do("GET", "/api/x", nil)
+		statuses[resp.StatusCode]++
+		if resp.StatusCode == http.StatusGatewayTimeout && !strings.Contains(string(body), `"upstream_timeout"`) {
+			t.Errorf("504 without its code: %s", body)
+		}
+	}
+	// timeouts are not retried: the impatient upstream's request fails
+	if statuses[http.StatusOK] != 1 || statuses[http.StatusGatewayTimeout] != 1 {
+		t.Errorf("got %v, want one 200 and one 504", statuses)
+	}
+}
+
+func TestProxyCookies(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+	}
+	up := newUpstream(t, "up", echo)
+	for _, forward := range []bool{false, true} {
+		t.Run(fmt.Sprint("forward_cookies=", forward), func(t *testing.T) {
+			route := proxyRoute("round_robin", up.URL)
+			route.ForwardCookies = forward
+			srv := startTestServer(t, withProxy(route))
+			client := newTestClient(t, srv)
+			client.login("alicesmith")
+			u, _ := url.Parse(srv.URL)
+			client.http.Jar.SetCookies(u, []*http.Cookie{{Name: "theirs", Value: "1"}})
+
+			resp, _ := client.do("GET", "/api/x", nil)
+			sent := resp.Header.Get("X-Cookie")
+			if !strings.Contains(sent, "theirs=1") {
+				t.Errorf("upstream cookie not sent: %q", sent)
+			}
+			for _, own := range []string{Sessions.CookieName + "=", csrfCookie + "="} {
+				if strings.Contains(sent, own) != forward {
+					t.Errorf("sent %q", sent)
+				}
+			}
+		})
+	}
+}
+
+// waitFor polls ok for up to two seconds.
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ok() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxLimitClients bounds the buckets a RateLimiter keeps. Past it the
+// least recently seen client is forgotten, which only hands it a full bucket.
+const maxLimitClients = 10000
+
+// RouteLimit is one entry of the limits section of the config file.
+type RouteLimit struct {
+	Rate    int    // requests per minute; 0 for that of the next route that sets one
+	Burst   int    // requests allowed at once; at least 1
+	By      string // "user": the logged in user, else the IP; "ip": always the IP
+	MaxBody int64  // request body bytes; 0 for that of the next route that sets one
+}
+
+// defaultLimits is used when the config file has no limits section.
+var defaultLimits = map[string]RouteLimit{
+	"*": {Rate: 600, Burst: 100, By: "user", MaxBody: 1 << 20},
+}
+
+type limitRule struct {
+	route
+	key string // the config key, to keep each route's buckets apart
+	RouteLimit
+}
+
+// RateLimiter gives every client a token bucket per route, and caps the
+// size of request bodies. The most specific route in the limits section
+// applies; "*" covers the rest. A route without a rate or max_body takes
+// that of the most specific route that has one, so that a body limit for
+// a route does not lift the rate limit of "*", nor the other way round.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rules   []limitRule
+	buckets map[string]*list.Element // of *bucket
+	recent  *list.List               // most recently seen first
+}
+
+type bucket struct {
+	id     string // rule key and client
+	tokens float64
+	last   time.Time
+	full   time.Time // when the bucket will have refilled
+}
+
+// NewRateLimiter parses the limits section of the config file.
+func NewRateLimiter(limits map[string]RouteLimit) (*RateLimiter, error) {
+	l := &RateLimiter{buckets: make(map[string]*list.Element), recent: list.New()}
+	for key, limit := range limits {
+		rt, err := parseRoute(key)
+		if err != nil {
+			return nil, fmt.Errorf("limits: %v", err)
+		}
+		switch {
+		case limit.Rate < 0 || limit.Burst < 0 || limit.MaxBody < 0:
+			return nil, fmt.Errorf("limits: %q: rate, burst and max_body must not be negative", key)
+		case limit.By != "user" && limit.By != "ip":
+			return nil, fmt.Errorf("limits: %q: by %q is not one of user or ip", key, limit.By)
+		}
+		if limit.Burst == 0 {
+			limit.Burst = 1
+		}
+		l.rules = append(l.rules, limitRule{route: rt, key: key, RouteLimit: limit})
+	}
+	sort.Slice(l.rules, func(i, j int) bool { return l.rules[i].before(l.rules[j].route) })
+	return l, nil
+}
+
+// Replace swaps in the rules of m, for config reloads. Buckets of routes
+// that are still there carry on.
+func (l *RateLimiter) Replace(m *RateLimiter) {
+	m.mu.Lock()
+	rules := m.rules
+	m.mu.Unlock()
+	l.mu.Lock()
+	l.rules = rules
+	l.mu.Unlock()
+}
+
+// rateRule is the rule that rate limits r: the most specific route that
+// sets a rate.
+func (l *RateLimiter) rateRule(r *http.Request) (limitRule, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rule := range l.rules {
+		if rule.Rate > 0 && rule.matches(r) {
+			return rule, true
+		}
+	}
+	return limitRule{}, false
+}
+
+// maxBody is the body limit for r, from the most specific route that sets
+// one, or 0 for none.
+func (l *RateLimiter) maxBody(r *http.Request) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rule := range l.rules {
+		if rule.MaxBody > 0 && rule.matches(r) {
+			return rule.MaxBody
+		}
+	}
+	return 0
+}
+
+// take spends a token of client's bucket for rule, or says how long
+// until there is one.
+func (l *RateLimiter) take(rule limitRule, client string, now time.Time) (bool, time.Duration) {
+	perSecond := float64(rule.Rate) / 60
+	id := rule.key + "\x00" + client
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// buckets that have refilled are as good as new ones: drop them
+	for e := l.recent.Back(); e != nil; e = l.recent.Back() {
+		b := e.Value.(*bucket)
+		if len(l.buckets) < maxLimitClients && now.Before(b.full) {
+			break
+		}
+		l.recent.Remove(e)
+		delete(l.buckets, b.id)
+	}
+
+	var b *bucket
+	if e, ok := l.buckets[id]; ok {
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(float64(rule.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+		l.recent.MoveToFront(e)
+	} else {
+		b = &bucket{id: id, tokens: float64(rule.Burst)}
+		l.buckets[id] = l.recent.PushFront(b)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.full = now.Add(fromSeconds((float64(rule.Burst) - b.tokens) / perSecond))
+		return false, fromSeconds((1 - b.tokens) / perSecond)
+	}
+	b.tokens--
+	b.full = now.Add(fromSeconds((float64(rule.Burst) - b.tokens) / perSecond))
+	return true, 0
+}
+
+func fromSeconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Middleware answers 429, with a Retry-After header, to clients that
+// have used up their bucket, and limits the body the handlers may read.
+// Reading past the limit fails with an *http.MaxBytesError, which
+// badRequestBody turns into a 413. It must come before any middleware
+// that reads the body, such as CSRF with a form.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit := l.maxBody(r); limit > 0 {
+			if r.ContentLength > limit {
+				WriteError(w, r, bodyTooLarge(limit))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		if rule, ok := l.rateRule(r); ok {
+			if ok, wait := l.take(rule, limitClient(r, rule.By), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				WriteError(w, r, NewHTTPError(http.StatusTooManyRequests, "too many requests to %s; try again later", r.URL.Path).WithCode("rate_limited"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitClient names whom a request's tokens come from. There is no proxy
+// in front of this server to trust, so X-Forwarded-For is ignored.
+func limitClient(r *http.Request, by string) string {
+	if by == "user" {
+		if username := CurrentUsername(r); username != "" {
+			return "user:" + username
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func bodyTooLarge(limit int64) *HTTPError {
+	return NewHTTPError(http.StatusRequestEntityTooLarge, "request body is larger than %d bytes", limit).WithCode("body_too_large")
+}
+
+// badRequestBody is the error for a request body that would not parse:
+// 413 if it ran over the size limit, else a 400 saying format.
+func badRequestBody(err error, format string, args ...interface{}) *HTTPError {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return bodyTooLarge(tooBig.Limit)
+	}
+	return NewHTTPError(http.StatusBadRequest, format, args...)
+}
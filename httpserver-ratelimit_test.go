@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withLimits(limits map[string]RouteLimit) func(*Settings) {
+	return func(s *Settings) { s.Limits = limits }
+}
+
+// expectLimited checks that the next GET of path is refused with a 429.
+func expectLimited(c *testClient, path string) {
+	c.t.Helper()
+	resp, body := c.do("GET", path, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || !strings.Contains(string(body), `"rate_limited"`) {
+		c.t.Fatalf("GET %s: got %s %s, want 429 rate_limited", path, resp.Status, body)
+	}
+	// a token a second
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		c.t.Errorf("Retry-After %q, want 1", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := startTestServer(t, withLimits(map[string]RouteLimit{
+		"*":      {Rate: 600, Burst: 100, By: "user", MaxBody: 1 << 20},
+		"/users": {Rate: 60, Burst: 2, By: "ip"},
+	}))
+	c := newTestClient(t, srv)
+
+	hits(c, "GET", "/users", 2)
+	expectLimited(c, "/users")
+
+	// other routes have buckets of their own, and so do other clients
+	// when counted by user, but not by IP
+	if resp, _ := c.do("GET", "/user/joesample", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /user/joesample: %s", resp.Status)
+	}
+	other := newTestClient(t, srv)
+	other.login("alicesmith")
+	expectLimited(other, "/users")
+}
+
+func TestRateLimitInherited(t *testing.T) {
+	// a route that only limits bodies keeps the rate of "*"
+	srv := startTestServer(t, withLimits(map[string]RouteLimit{
+		"*":      {Rate: 60, Burst: 2, By: "ip", MaxBody: 1 << 20},
+		"/users": {By: "user", MaxBody: 4096},
+	}))
+	c := newTestClient(t, srv)
+
+	hits(c, "GET", "/users", 2)
+	expectLimited(c, "/users")
+}
+
+func TestBodyLimit(t *testing.T) {
+	srv := startTestServer(t, withLimits(map[string]RouteLimit{
+		"*":            {Rate: 600, Burst: 100, By: "user", MaxBody: 1 << 20},
+		"PATCH /user/": {By: "user", MaxBody: 64},
+	}))
+	c := newTestClient(t, srv)
+	c.login("joesample")
+
+	if resp, body := c.do("PATCH", "/user/alicesmith", map[string]string{"firstname": "Alicia"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH under the limit: %s %s", resp.Status, body)
+	}
+
+	long := map[string]string{"firstname": strings.Repeat("A", 100)}
+	resp, body := c.do("PATCH", "/user/alicesmith", long)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), `"body_too_large"`) {
+		t.Errorf("declared length over the limit: got %s %s, want 413", resp.Status, body)
+	}
+
+	// the same body chunked, with no length to refuse it by up front
+	payload := `{"firstname": "` + strings.Repeat("A", 100) + `"}`
+	req, err := http.NewRequest("PATCH", c.base+"/user/alicesmith", struct{ io.Reader }{strings.NewReader(payload)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(csrfHeader, c.cookie(csrfCookie))
+	if req.ContentLength != 0 {
+		t.Fatalf("the request has a length of %d", req.ContentLength)
+	}
+	streamed, err := c.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(streamed.Body)
+	streamed.Body.Close()
+	if streamed.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(b), `"body_too_large"`) {
+		t.Errorf("streamed body over the limit: got %s %s, want 413", streamed.Status, b)
+	}
+
+	if resp, body := c.do("GET", "/user/alicesmith", nil); resp.StatusCode != http.StatusOK || strings.Contains(string(body), "AAAA") {
+		t.Errorf("the refused PATCHes went through: %s", body)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// config holds the settings the server is running with.
+var config atomic.Pointer[Settings]
+
+// Config returns the settings in effect. A reload swaps in a new
+// *Settings, so handlers should call Config rather than keep one.
+func Config() *Settings {
+	return config.Load()
+}
+
+// liveSettings returns old with the settings that can change while the
+// server runs taken from new. Changing any of the others needs a restart.
+func liveSettings(old, new *Settings) *Settings {
+	s := *old
+	s.Dir = new.Dir
+	s.DevMode = new.DevMode
+	s.DirListing = new.DirListing
+	s.CacheControl = new.CacheControl
+	s.Compress = new.Compress
+	s.CompressMinSize = new.CompressMinSize
+	s.CompressTypes = new.CompressTypes
+	s.RedirectCode = new.RedirectCode
+	s.Access = new.Access
+	s.Limits = new.Limits
+	s.Rules = new.Rules
+	s.CORS = new.CORS
+	s.LogLevel = new.LogLevel
+	s.EventsHeartbeat = new.EventsHeartbeat
+	return &s
+}
+
+// reloadableStore is a user store whose users file can be re-read.
+type reloadableStore interface {
+	Reload() error
+}
+
+// rewritingStore is a user store that saves its users to the users file
+// itself. Written is the file as the store last left it, so that the
+// watcher does not mistake the store's own saves for outside edits.
+type rewritingStore interface {
+	Written() fileStamp
+}
+
+// Reloader re-reads the config and users files when they change on disk
+// or the process gets SIGHUP. A file that does not validate is logged and
+// ignored, and the server carries on with what it had.
+type Reloader struct {
+	args []string
+
+	mu       sync.Mutex
+	appliers []func(s *Settings)
+	stamps   map[string]fileStamp
+}
+
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// NewReloader reloads with the command-line args the server started with,
+// so flags and environment variables keep overriding the file.
+func NewReloader(args []string) *Reloader {
+	return &Reloader{args: args, stamps: make(map[string]fileStamp)}
+}
+
+// OnReload registers fn to apply a new config. The settings fn gets have
+// already been validated.
+func (rl *Reloader) OnReload(fn func(s *Settings)) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.appliers = append(rl.appliers, fn)
+}
+
+// ReloadConfig loads the config file again and swaps in the result if it
+// is valid. Settings that can only change on a restart keep their old
+// values and are logged.
+func (rl *Reloader) ReloadConfig() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	old := Config()
+	next, err := LoadSettings(rl.args)
+	if err != nil {
+		var problems []string
+		var ce *ConfigError
+		if errors.As(err, &ce) {
+			problems = ce.Problems
+		} else {
+			problems = []string{err.Error()}
+		}
+		Logger.Error("config reload rejected; keeping the running config", "file", old.ConfigPath, "problems", problems)
+		if next != nil {
+			// settings that only change on a restart were never going to
+			// apply now, valid or not; keep them out of the rejected ones
+			live := liveSettings(old, next)
+			for _, c := range old.Diff(live) {
+				Logger.Error("rejected config change", "setting", c.Name, "running", c.Old, "rejected", c.New)
+			}
+			rl.logRestartOnly(live, next)
+		}
+		return err
+	}
+
+	live := liveSettings(old, next)
+	rl.logRestartOnly(live, next)
+	changes := old.Diff(live)
+	if len(changes) == 0 {
+		return nil
+	}
+	config.Store(live)
+	for _, fn := range rl.appliers {
+		fn(live)
+	}
+	names := make([]string, len(changes))
+	for i, c := range changes {
+		Logger.Info("config reloaded", "setting", c.Name, "old", c.Old, "new", c.New)
+		names[i] = c.Name
+	}
+	// names only: /events is no place for the values
+	Events.Publish("config.reloaded", map[string]interface{}{"settings": names})
+	return nil
+}
+
+// logRestartOnly logs the settings in which next differs from live, the
+// config that can be applied without a restart.
+func (rl *Reloader) logRestartOnly(live, next *Settings) {
+	for _, c := range live.Diff(next) {
+		Logger.Warn("config change needs a restart", "setting", c.Name, "running", c.Old, "new", c.New)
+	}
+}
+
+// usersFile is a users file and the store of the site loaded from it.
+type usersFile struct {
+	site  string
+	path  string
+	kind  string
+	store UserStore
+}
+
+// usersFiles lists the top-level users file and those of the sites
+// that have their own.
+func usersFiles() []usersFile {
+	files := []usersFile{{"", Config().UsersPath, Config().UserStore, Store}}
+	if Sites != nil {
+		for _, site := range Sites.All() {
+			if site.store != nil {
+				files = append(files, usersFile{site.Name, site.usersPath, site.storeKind, site.store})
+			}
+		}
+	}
+	return files
+}
+
+// ReloadUsers re-reads every users file into its user store, if the store
+// is backed by it. A broken file leaves the loaded users in place.
+func (rl *Reloader) ReloadUsers() error {
+	var errs []error
+	for _, f := range usersFiles() {
+		errs = append(errs, rl.reloadUsers(f))
+	}
+	return errors.Join(errs...)
+}
+
+func (rl *Reloader) reloadUsers(f usersFile) error {
+	store, ok := f.store.(reloadableStore)
+	if !ok {
+		Logger.Debug("user store does not reload", "site", f.site, "kind", f.kind)
+		return nil
+	}
+	if err := store.Reload(); err != nil {
+		Logger.Error("users reload rejected; keeping the loaded users", "file", f.path, "err", err)
+		return err
+	}
+	users, _ := f.store.List()
+	Logger.Info("users reloaded", "file", f.path, "users", len(users))
+	Events.PublishSite(f.site, "users.reloaded", map[string]interface{}{"users": len(users)})
+	return nil
+}
+
+// Watch reloads both files on SIGHUP and, every interval, whichever of them
+// changed. An interval of zero leaves it to SIGHUP. Call stop to quit.
+func (rl *Reloader) Watch(interval time.Duration) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+		rl.changed(Config().ConfigPath)
+		for _, f := range usersFiles() {
+			rl.changed(f.path)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-hup:
+				Logger.Info("reloading on SIGHUP")
+				rl.ReloadConfig()
+				rl.ReloadUsers()
+			case <-tick:
+				if rl.changed(Config().ConfigPath) {
+					rl.ReloadConfig()
+				}
+				for _, f := range usersFiles() {
+					if rl.changed(f.path) && !rl.ownWrite(f) {
+						rl.reloadUsers(f)
+					}
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// ownWrite reports whether f's file is still as its store last saved it,
+// so that the change the watcher saw was the server's own.
+func (rl *Reloader) ownWrite(f usersFile) bool {
+	store, ok := f.store.(rewritingStore)
+	if !ok {
+		return false
+	}
+	rl.mu.Lock()
+	stamp := rl.stamps[f.path]
+	rl.mu.Unlock()
+	if stamp != store.Written() {
+		return false
+	}
+	Logger.Debug("users file saved by the server; not reloading", "site", f.site, "file", f.path)
+	return true
+}
+
+// changed reports whether path's size or modification time differs
+// from the last time it was looked at.
+func (rl *Reloader) changed(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		// a missing file is reported by the reload it would trigger
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	stamp := fileStamp{info.ModTime(), info.Size()}
+	old, seen := rl.stamps[path]
+	rl.stamps[path] = stamp
+	return seen && old != stamp
+}
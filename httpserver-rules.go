@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RuleSettings is one entry of the rules section of the config file,
+// which redirects or rewrites the requests it matches.
+type RuleSettings struct {
+	Priority      int    // higher goes first; ties go by name
+	Match         string // "exact", "prefix" or "regex"
+	Path          string
+	Host          string // "" for any; "*.example.com" takes subdomains
+	To            string // for regex, $1 or ${name} stand for captures
+	Status        int    // 301, 302, 307 or 308; 0 for redirect_code
+	PreserveQuery bool   // pass the request's query on to To
+	Rewrite       bool   // serve To here instead of redirecting to it
+}
+
+// defaultRules is used when the config file has no rules section.
+var defaultRules = map[string]RuleSettings{
+	"redirect": {Match: "exact", Path: "/redirect", To: "http://example.org"},
+}
+
+// compiledRule is a RuleSettings ready to match requests.
+type compiledRule struct {
+	name string
+	RuleSettings
+	re *regexp.Regexp
+}
+
+// RuleSet applies the first rule that matches a request, before the
+// request reaches the rest of the middleware. A rewrite is not looked at
+// again by the other rules, so rules cannot loop.
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules []*compiledRule
+}
+
+// NewRuleSet parses the rules section of the config file.
+func NewRuleSet(rules map[string]RuleSettings) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for name, settings := range rules {
+		rule := &compiledRule{name: name, RuleSettings: settings}
+		switch settings.Match {
+		case "exact", "prefix":
+			if !strings.HasPrefix(settings.Path, "/") {
+				return nil, fmt.Errorf("rules: %s: %q is not a path", name, settings.Path)
+			}
+		case "regex":
+			re, err := regexp.Compile(settings.Path)
+			if err != nil {
+				return nil, fmt.Errorf("rules: %s: %v", name, err)
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("rules: %s: match %q is not one of exact, prefix or regex", name, settings.Match)
+		}
+		switch {
+		case settings.To == "":
+			return nil, fmt.Errorf("rules: %s: no to", name)
+		case settings.Rewrite && settings.Status != 0:
+			return nil, fmt.Errorf("rules: %s: a rewrite has no status", name)
+		case settings.Rewrite && !strings.HasPrefix(settings.To, "/"):
+			return nil, fmt.Errorf("rules: %s: a rewrite must go to a path on this server", name)
+		}
+		switch settings.Status {
+		case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return nil, fmt.Errorf("rules: %s: status %d is not one of 301, 302, 307 or 308", name, settings.Status)
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+	sort.Slice(rs.rules, func(i, j int) bool {
+		a, b := rs.rules[i], rs.rules[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.name < b.name
+	})
+	return rs, nil
+}
+
+// Replace swaps in the rules of other, for config reloads.
+func (rs *RuleSet) Replace(other *RuleSet) {
+	other.mu.RLock()
+	rules := other.rules
+	other.mu.RUnlock()
+	rs.mu.Lock()
+	rs.rules = rules
+	rs.mu.Unlock()
+}
+
+// Match returns the first rule for r and where it sends r, with the
+// query added when the rule keeps it, or nil.
+func (rs *RuleSet) Match(r *http.Request) (*compiledRule, string) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	for _, rule := range rs.rules {
+		if target, ok := rule.apply(r); ok {
+			return rule, target
+		}
+	}
+	return nil, ""
+}
+
+func (rule *compiledRule) apply(r *http.Request) (string, bool) {
+	if rule.Host != "" && !hostMatches(rule.Host, r.Host) {
+		return "", false
+	}
+	path := r.URL.Path
+	var target string
+	switch rule.Match {
+	case "exact":
+		if path != rule.Path {
+			return "", false
+		}
+		target = rule.To
+	case "prefix":
+		if !strings.HasPrefix(path, rule.Path) {
+			return "", false
+		}
+		target = rule.To + path[len(rule.Path):]
+	case "regex":
+		m := rule.re.FindStringSubmatchIndex(path)
+		if m == nil {
+			return "", false
+		}
+		target = string(rule.re.ExpandString(nil, rule.To, path, m))
+	}
+	if rule.PreserveQuery && r.URL.RawQuery != "" {
+		if strings.Contains(target, "?") {
+			target += "&" + r.URL.RawQuery
+		} else {
+			target += "?" + r.URL.RawQuery
+		}
+	}
+	return target, true
+}
+
+// hostMatches reports whether host, which may carry a port, is pattern
+// or, for "*.example.com", one of its subdomains.
+func hostMatches(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// status is the redirect status of rule, which follows redirect_code
+// unless the rule names its own.
+func (rule *compiledRule) status() int {
+	if rule.Status != 0 {
+		return rule.Status
+	}
+	return Config().RedirectCode
+}
+
+// serve redirects r if a rule matches it, or passes it on to next with
+// the path and query of a rewrite. SiteTable.Middleware picks the RuleSet.
+func (rs *RuleSet) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rule, target := rs.Match(r)
+	if rule == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	if !rule.Rewrite {
+		noteRedirect(r, rule.name)
+		http.Redirect(w, r, target, rule.status())
+		return
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		WriteError(w, r, NewHTTPError(http.StatusInternalServerError, "rule %s: bad rewrite %q", rule.name, target).WithCode("bad_rewrite"))
+		return
+	}
+	Logger.Debug("rewrite", "request_id", RequestID(r), "rule", rule.name, "from", r.URL.Path, "to", u.Path)
+	r = r.Clone(r.Context())
+	r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	noteRewrite(r)
+	next.ServeHTTP(w, r)
+}
+
+// RuleView describes a rule on /debug/rules.
+type RuleView struct {
+	Name          string `json:"name"`
+	Priority      int    `json:"priority"`
+	Match         string `json:"match"`
+	Path          string `json:"path"`
+	Host          string `json:"host,omitempty"`
+	To            string `json:"to"`
+	Status        int    `json:"status,omitempty"`
+	PreserveQuery bool   `json:"preserve_query"`
+	Rewrite       bool   `json:"rewrite"`
+}
+
+// RuleMatch is what a rule does with the URL asked about on /debug/rules.
+type RuleMatch struct {
+	Rule     string `json:"rule"`
+	Action   string `json:"action"` // "redirect" or "rewrite"
+	Status   int    `json:"status,omitempty"`
+	Location string `json:"location"`
+}
+
+// DebugHandler lists the rules in the order they are tried and, for
+//
+//	GET /debug/rules?url=http://www.example.com/old/page?x=1
+//
+// which of them takes the URL (a path alone is taken to be on this host),
+// and what it does. "match" is null when no rule does.
+func (rs *RuleSet) DebugHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	result := struct {
+		URL   string     `json:"url,omitempty"`
+		Match *RuleMatch `json:"match"`
+		Rules []RuleView `json:"rules"`
+	}{Rules: []RuleView{}}
+
+	rs.mu.RLock()
+	for _, rule := range rs.rules {
+		result.Rules = append(result.Rules, RuleView{rule.name, rule.Priority, rule.Match, rule.Path, rule.Host, rule.To, rule.Status, rule.PreserveQuery, rule.Rewrite})
+	}
+	rs.mu.RUnlock()
+
+	raw := request.URL.Query().Get("url")
+	if raw == "" {
+		return result, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasPrefix(u.Path, "/") {
+		return nil, NewHTTPError(http.StatusBadRequest, "url %q is not a URL or path", raw).WithCode("bad_url")
+	}
+	host := u.Host
+	if host == "" {
+		host = request.Host
+	}
+	result.URL = raw
+	rule, target := rs.Match(&http.Request{Method: "GET", Host: host, URL: u})
+	if rule != nil {
+		result.Match = &RuleMatch{Rule: rule.name, Action: "redirect", Location: target}
+		if rule.Rewrite {
+			result.Match.Action = "rewrite"
+		} else {
+			result.Match.Status = rule.status()
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewRuleSetRefuses(t *testing.T) {
+	for _, tt := range []struct {
+		settings RuleSettings
+		want     string
+	}{
+		{RuleSettings{Match: "exact", Path: "old", To: "/new"}, "is not a path"},
+		{RuleSettings{Match: "regex", Path: "^/(unclosed$", To: "/new"}, "missing closing )"},
+		{RuleSettings{Match: "glob", Path: "/old/*", To: "/new"}, "is not one of exact, prefix or regex"},
+		{RuleSettings{Match: "prefix", Path: "/old/"}, "no to"},
+		{RuleSettings{Match: "exact", Path: "/old", To: "/new", Rewrite: true, Status: 301}, "a rewrite has no status"},
+		{RuleSettings{Match: "exact", Path: "/old", To: "https://example.com/new", Rewrite: true}, "must go to a path"},
+		{RuleSettings{Match: "exact", Path: "/old", To: "/new", Status: 303}, "status 303"},
+	} {
+		_, err := NewRuleSet(map[string]RuleSettings{"bad": tt.settings})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got %v, want an error about %q", tt.settings, err, tt.want)
+		}
+	}
+}
+
+func TestRuleSetServe(t *testing.T) {
+	config.Store(testSettings(t))
+	rs, err := NewRuleSet(map[string]RuleSettings{
+		"old":   {Match: "exact", Path: "/old", To: "/new", Status: http.StatusMovedPermanently},
+		"docs":  {Match: "prefix", Path: "/docs/", To: "https://docs.example.com/", PreserveQuery: true},
+		"wiki":  {Match: "prefix", Path: "/", Host: "wiki.example.com", To: "https://example.com/wiki/"},
+		"subs":  {Match: "exact", Path: "/x", Host: "*.example.net", To: "/sub-x"},
+		"user":  {Match: "regex", Path: `^/u/(?P<name>\w+)$`, To: "/user/${name}", Rewrite: true, PreserveQuery: true},
+		"post":  {Match: "regex", Path: `^/p/(\d+)/(\d+)$`, To: "/posts?year=$1&id=$2", PreserveQuery: true},
+		"plain": {Match: "prefix", Path: "/static/", To: "/assets/", Rewrite: true},
+		"low":   {Match: "exact", Path: "/both", To: "/low"},
+		"high":  {Match: "exact", Path: "/both", To: "/high", Priority: 5},
+		"tie-a": {Match: "exact", Path: "/tie", To: "/a"},
+		"tie-b": {Match: "exact", Path: "/tie", To: "/b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		url    string
+		status int    // of a redirect, or 200 for next
+		want   string // Location, or the path and query next saw
+	}{
+		{"http://example.com/old", http.StatusMovedPermanently, "/new"},
+		{"http://example.com/old?x=1", http.StatusMovedPermanently, "/new"},
+		{"http://example.com/older", http.StatusOK, "/older"},
+		{"http://example.com/docs/a/b?x=1&y=2", http.StatusTemporaryRedirect, "https://docs.example.com/a/b?x=1&y=2"},
+
+		// host conditions
+		{"http://wiki.example.com/Main_Page", http.StatusTemporaryRedirect, "https://example.com/wiki/Main_Page"},
+		{"http://WIKI.example.com.:8080/", http.StatusTemporaryRedirect, "https://example.com/wiki/"},
+		{"http://a.wiki.example.com/Main_Page", http.StatusOK, "/Main_Page"},
+		{"http://www.example.net/x", http.StatusTemporaryRedirect, "/sub-x"},
+		{"http://a.b.example.net/x", http.StatusTemporaryRedirect, "/sub-x"},
+		{"http://example.net/x", http.StatusOK, "/x"},
+
+		// captures, by name and number, and queries
+		{"http://example.com/u/joesample", http.StatusOK, "/user/joesample"},
+		{"http://example.com/u/joesample?fields=name", http.StatusOK, "/user/joesample?fields=name"},
+		{"http://example.com/u/joe/sample", http.StatusOK, "/u/joe/sample"},
+		{"http://example.com/p/2024/7?x=1", http.StatusTemporaryRedirect, "/posts?year=2024&id=7&x=1"},
+		{"http://example.com/static/app.js?v=3", http.StatusOK, "/assets/app.js"},
+
+		// priority, then name
+		{"http://example.com/both", http.StatusTemporaryRedirect, "/high"},
+		{"http://example.com/tie", http.StatusTemporaryRedirect, "/a"},
+	} {
+		var saw string
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			saw = r.URL.Path
+			if r.URL.RawQuery != "" {
+				saw += "?" + r.URL.RawQuery
+			}
+		})
+		w := httptest.NewRecorder()
+		rs.serve(w, httptest.NewRequest("GET", tt.url, nil), next)
+
+		got := w.Header().Get("Location")
+		if w.Code == http.StatusOK {
+			got = saw
+		}
+		if w.Code != tt.status || got != tt.want {
+			t.Errorf("GET %s: got %d %q, want %d %q", tt.url, w.Code, got, tt.status, tt.want)
+		}
+	}
+}
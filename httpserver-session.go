@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is the server side state behind a session cookie.
+type Session struct {
+	ID       string            `json:"id"`
+	Username string            `json:"username,omitempty"`
+	Created  time.Time         `json:"created"`
+	Rotated  time.Time         `json:"rotated"`
+	Expires  time.Time         `json:"expires"`
+	Values   map[string]string `json:"values,omitempty"`
+}
+
+// SessionStore keeps sessions on the server; the cookie only carries the signed ID.
+type SessionStore interface {
+	Get(id string) (*Session, error)
+	Save(s *Session) error
+	Delete(id string) error
+	DeleteExpired(now time.Time) error
+	Close() error
+}
+
+// MemorySessionStore keeps sessions in a map; they are lost on restart.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *MemorySessionStore) Get(id string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	sess.Values = copyValues(sess.Values)
+	return &sess, nil
+}
+
+func (s *MemorySessionStore) Save(sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp := *sess
+	cp.Values = copyValues(sess.Values)
+	s.sessions[sess.ID] = cp
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if now.After(sess.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Close() error { return nil }
+
+func copyValues(values map[string]string) map[string]string {
+	cp := make(map[string]string, len(values))
+	for k, v := range values {
+		cp[k] = v
+	}
+	return cp
+}
+
+// FileSessionStore keeps one JSON file per session in dir, so sessions
+// survive a restart. File names are hashes of the session IDs.
+type FileSessionStore struct {
+	dir string
+}
+
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+func (s *FileSessionStore) path(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *FileSessionStore) Get(id string) (*Session, error) {
+	b, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal(b, &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *FileSessionStore) Save(sess *Session) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(sess.ID), b, 0600)
+}
+
+func (s *FileSessionStore) Delete(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileSessionStore) DeleteExpired(now time.Time) error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var sess Session
+		if json.Unmarshal(b, &sess) != nil || now.After(sess.Expires) {
+			os.Remove(p)
+		}
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Close() error { return nil }
+
+// SessionManager issues HMAC-signed session cookies and keeps the
+// sessions they point at in a SessionStore.
+type SessionManager struct {
+	Store       SessionStore
+	CookieName  string
+	Secret      []byte
+	TTL         time.Duration // lifetime of a session
+	RotateAfter time.Duration // a session gets a new ID once it is this old
+	Secure      bool          // send the cookie over HTTPS only
+
+	stop chan struct{}
+}
+
+// NewSessionManager builds the manager from settings and starts a janitor
+// that drops expired sessions once a minute.
+func NewSessionManager(s *Settings) (*SessionManager, error) {
+	var store SessionStore
+	switch s.SessionStore {
+	case "memory":
+		store = NewMemorySessionStore()
+	case "file":
+		fs, err := NewFileSessionStore(s.SessionDir)
+		if err != nil {
+			return nil, err
+		}
+		store = fs
+	default:
+		return nil, errors.New("unknown session store " + s.SessionStore)
+	}
+	secret := []byte(s.SessionSecret)
+	if len(secret) == 0 {
+		Logger.Warn("no session_secret configured; sessions will not survive a restart")
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+	m := &SessionManager{
+		Store:       store,
+		CookieName:  s.SessionCookie,
+		Secret:      secret,
+		TTL:         s.SessionTTL,
+		RotateAfter: s.SessionRotate,
+		Secure:      s.SessionSecure,
+		stop:        make(chan struct{}),
+	}
+	go m.janitor(time.Minute)
+	return m, nil
+}
+
+func (m *SessionManager) janitor(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			if err := m.Store.DeleteExpired(now); err != nil {
+				Logger.Error("session janitor", "err", err)
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *SessionManager) Close() error {
+	close(m.stop)
+	return m.Store.Close()
+}
+
+func (m *SessionManager) sign(id string) string {
+	mac := hmac.New(sha256.New, m.Secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the session ID in a cookie value if its signature is good.
+func (m *SessionManager) verify(value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	return id, hmac.Equal([]byte(m.sign(id)), []byte(value))
+}
+
+func newSessionID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *SessionManager) setCookie(w http.ResponseWriter, sess *Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.CookieName,
+		Value:    m.sign(sess.ID),
+		Path:     "/",
+		Expires:  sess.Expires,
+		MaxAge:   int(time.Until(sess.Expires).Seconds()),
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (m *SessionManager) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// load returns the live session named by the request's cookie, or nil.
+func (m *SessionManager) load(r *http.Request) *Session {
+	cookie, err := r.Cookie(m.CookieName)
+	if err != nil {
+		return nil
+	}
+	id, ok := m.verify(cookie.Value)
+	if !ok {
+		return nil
+	}
+	sess, err := m.get(id)
+	if err != nil {
+		return nil
+	}
+	if next := sess.Values[rotatedToKey]; next != "" {
+		// an old ID still in flight on a request sent before the rotation
+		if sess, err = m.get(next); err != nil {
+			return nil
+		}
+	}
+	return sess
+}
+
+// get returns the session with id unless it has expired.
+func (m *SessionManager) get(id string) (*Session, error) {
+	sess, err := m.Store.Get(id)
+	if err != nil {
+		if err != ErrSessionNotFound {
+			Logger.Error("session store", "err", err)
+		}
+		return nil, err
+	}
+	if time.Now().After(sess.Expires) {
+		m.Store.Delete(id)
+		return nil, ErrSessionNotFound
+	}
+	return sess, nil
+}
+
+// Refresh returns what has become of sess, which a long-lived connection
+// got when it opened: the same session, re-read, or the one it was rotated
+// to, or nil once it has been logged out or has expired. Connections
+// should call it at least every sessionRecheck, to follow a rotation
+// before the old ID stops working.
+func (m *SessionManager) Refresh(sess *Session) *Session {
+	cur, err := m.get(sess.ID)
+	if err != nil {
+		return nil
+	}
+	if next := cur.Values[rotatedToKey]; next != "" {
+		if cur, err = m.get(next); err != nil {
+			return nil
+		}
+	}
+	if cur.Username != sess.Username || cur.Values[siteValueKey] != sess.Values[siteValueKey] {
+		return nil
+	}
+	return cur
+}
+
+// sessionRecheck is how often long-lived connections call Refresh.
+const sessionRecheck = rotateGrace / 3
+
+// rotateGrace is how long an old session ID keeps working after a
+// rotation, for the requests a page already had under way with it.
+const rotateGrace = 30 * time.Second
+
+// rotatedToKey is where the stub left at an old ID keeps the new one.
+const rotatedToKey = "rotated_to"
+
+// rotate moves sess to a fresh ID, keeping its data. The old ID points
+// at the new one for rotateGrace and then expires.
+func (m *SessionManager) rotate(w http.ResponseWriter, sess *Session) error {
+	oldID := sess.ID
+	now := time.Now()
+	sess.ID = newSessionID()
+	sess.Rotated = now
+	if err := m.Store.Save(sess); err != nil {
+		return err
+	}
+	stub := &Session{ID: oldID, Created: sess.Created, Rotated: now, Expires: now.Add(rotateGrace), Values: map[string]string{rotatedToKey: sess.ID}}
+	if err := m.Store.Save(stub); err != nil {
+		m.Store.Delete(oldID)
+	}
+	m.setCookie(w, sess)
+	return nil
+}
+
+const sessionKey contextKey = "session"
+
+// Middleware puts the request's session, if any, in the request context
+// and gives it a new ID once it is older than RotateAfter.
+func (m *SessionManager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sess := m.load(r); sess != nil {
+			if m.RotateAfter > 0 && time.Since(sess.Rotated) > m.RotateAfter {
+				if err := m.rotate(w, sess); err != nil {
+					Logger.Error("session rotate", "err", err)
+				}
+			}
+			SetLogUser(r, sess.Username)
+			r = r.WithContext(context.WithValue(r.Context(), sessionKey, sess))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CurrentSession returns the session Middleware found for r, or nil.
+func CurrentSession(r *http.Request) *Session {
+	sess, _ := r.Context().Value(sessionKey).(*Session)
+	return sess
+}
+
+// siteValueKey is where a session keeps the site it logged in to.
+const siteValueKey = "site"
+
+// CurrentUsername returns the logged in user's name, or "". A login
+// counts only on the site it was made on, whose users it belongs to.
+func CurrentUsername(r *http.Request) string {
+	if sess := CurrentSession(r); sess != nil && sess.Values[siteValueKey] == SiteFor(r).Name {
+		return sess.Username
+	}
+	return ""
+}
+
+// Login starts a new session for username, replacing any session the
+// request came with so that a planted session ID is never promoted.
+func (m *SessionManager) Login(w http.ResponseWriter, r *http.Request, username string) (*Session, error) {
+	now := time.Now()
+	if old := CurrentSession(r); old != nil {
+		m.Store.Delete(old.ID)
+	}
+	sess := &Session{
+		ID:       newSessionID(),
+		Username: username,
+		Created:  now,
+		Rotated:  now,
+		Expires:  now.Add(m.TTL),
+		// a new CSRF token too, sent now so that scripts can use it at once
+		Values: map[string]string{csrfValueKey: newSessionID(), siteValueKey: SiteFor(r).Name},
+	}
+	if err := m.Store.Save(sess); err != nil {
+		return nil, err
+	}
+	m.setCookie(w, sess)
+	setCSRFCookie(w, sess.Values[csrfValueKey])
+	return sess, nil
+}
+
+// Logout ends the request's session and clears the cookie.
+func (m *SessionManager) Logout(w http.ResponseWriter, r *http.Request) error {
+	m.clearCookie(w)
+	if sess := CurrentSession(r); sess != nil {
+		return m.Store.Delete(sess.ID)
+	}
+	return nil
+}
+
+// LogoutHandler ends the current session: POST /logout
+func LogoutHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	if request.Method != "POST" {
+		response.Header().Set("Allow", "POST")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+	}
+	if err := Sessions.Logout(response, request); err != nil {
+		return nil, err
+	}
+	return NoContent, nil
+}
+
+// MeHandler returns the logged in user: GET /me
+func MeHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	username := CurrentUsername(request)
+	if username == "" {
+		return nil, NewHTTPError(http.StatusUnauthorized, "not logged in").WithCode("not_logged_in")
+	}
+	user, err := UserStoreFor(request).Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	return newUserResource(user), nil
+}
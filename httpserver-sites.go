@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Sites picks the site that serves each request.
+var Sites *SiteTable
+
+// SiteSettings is one entry of the sites section of the config file,
+// keyed by a host such as "wiki.example.com" or "*.tools.example.com".
+type SiteSettings struct {
+	Dir    string
+	Routes []string                // routes served besides the static files; nil for all
+	Rules  map[string]RuleSettings // nil for the top-level rules
+
+	// the site's own users; with no UsersPath it shares the top-level ones
+	UserStore     string
+	UsersPath     string
+	UserStorePath string
+}
+
+// Site is a set of hosts with their own files, routes, rules and users.
+// The default site, named "", is the top level of the config file.
+type Site struct {
+	Name      string  // host pattern; "" for the default site
+	dir       string  // "" for the top-level dir, which can be reloaded
+	routes    []route // nil for all
+	rules     *RuleSet
+	store     UserStore // nil for Store
+	storeKind string
+	usersPath string
+}
+
+// defaultSite is the site of requests when no sites are configured.
+var defaultSite = &Site{}
+
+// newSite checks the settings of the site for host and compiles its
+// routes and rules. Its user store is opened by OpenSites.
+func newSite(host string, settings SiteSettings) (*Site, error) {
+	pattern := strings.TrimPrefix(host, "*.")
+	if pattern == "" || strings.ContainsAny(pattern, "*:/ ") || host != strings.ToLower(host) {
+		return nil, fmt.Errorf("sites: %q is not a lower case host name, or *. and one", host)
+	}
+	site := &Site{Name: host, dir: settings.Dir, storeKind: settings.UserStore, usersPath: settings.UsersPath}
+	if settings.Dir == "" {
+		return nil, fmt.Errorf("sites: %s: no dir", host)
+	}
+	if settings.Routes != nil {
+		site.routes = []route{}
+		for _, key := range settings.Routes {
+			rt, err := parseRoute(key)
+			if err != nil {
+				return nil, fmt.Errorf("sites: %s: routes: %v", host, err)
+			}
+			site.routes = append(site.routes, rt)
+		}
+	}
+	if settings.Rules != nil {
+		rules, err := NewRuleSet(settings.Rules)
+		if err != nil {
+			return nil, fmt.Errorf("sites: %s: %v", host, err)
+		}
+		site.rules = rules
+	}
+	if settings.UsersPath != "" {
+		switch settings.UserStore {
+		case "file", "memory":
+		case "disk":
+			if settings.UserStorePath == "" {
+				return nil, fmt.Errorf("sites: %s: a disk user store needs user_store_path", host)
+			}
+		default:
+			return nil, fmt.Errorf("sites: %s: user_store %q is not one of file, memory or disk", host, settings.UserStore)
+		}
+	}
+	return site, nil
+}
+
+// Dir is the directory of the site's static files.
+func (s *Site) Dir() string {
+	if s.dir == "" {
+		return Config().Dir
+	}
+	return s.dir
+}
+
+// Users is the site's user store.
+func (s *Site) Users() UserStore {
+	if s.store == nil {
+		return Store
+	}
+	return s.store
+}
+
+// usersSite names the site whose users s has: its own name, or "" when
+// it shares the top-level ones.
+func (s *Site) usersSite() string {
+	if s.store == nil {
+		return ""
+	}
+	return s.Name
+}
+
+// SiteTable maps hosts to sites. Hosts no site claims go to the fallback.
+type SiteTable struct {
+	sites    []*Site // exact hosts first, then wildcards, longest first
+	fallback *Site
+	rules    *RuleSet // the top-level rules
+	mux      *http.ServeMux
+}
+
+// OpenSites sets up the sites section of settings and opens their user
+// stores. rules are the top-level rules, for sites that have none, and
+// mux tells the static files apart from the other routes.
+func OpenSites(settings *Settings, rules *RuleSet, mux *http.ServeMux) (*SiteTable, error) {
+	t := &SiteTable{fallback: defaultSite, rules: rules, mux: mux}
+	for host, ss := range settings.Sites {
+		site, err := newSite(host, ss)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		if ss.UsersPath != "" {
+			site.store, err = OpenUserStore(ss.UserStore, ss.UsersPath, ss.UserStorePath)
+			if err != nil {
+				t.Close()
+				return nil, fmt.Errorf("sites: %s: %v", host, err)
+			}
+		}
+		t.sites = append(t.sites, site)
+		if host == settings.DefaultSite {
+			t.fallback = site
+		}
+	}
+	sort.Slice(t.sites, func(i, j int) bool {
+		a, b := t.sites[i].Name, t.sites[j].Name
+		if wa, wb := strings.HasPrefix(a, "*."), strings.HasPrefix(b, "*."); wa != wb {
+			return wb
+		}
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return t, nil
+}
+
+// Lookup returns the site for host, which may carry a port.
+func (t *SiteTable) Lookup(host string) *Site {
+	for _, site := range t.sites {
+		if hostMatches(site.Name, host) {
+			return site
+		}
+	}
+	return t.fallback
+}
+
+// All returns the configured sites, without the default one.
+func (t *SiteTable) All() []*Site {
+	return t.sites
+}
+
+// Close closes the user stores the sites opened themselves.
+func (t *SiteTable) Close() error {
+	var errs []error
+	for _, site := range t.sites {
+		if site.store != nil {
+			errs = append(errs, site.store.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+const siteKey contextKey = "site"
+
+// SiteFor returns the site serving r.
+func SiteFor(r *http.Request) *Site {
+	if site, ok := r.Context().Value(siteKey).(*Site); ok {
+		return site
+	}
+	if Sites != nil {
+		return Sites.fallback
+	}
+	return defaultSite
+}
+
+// UserStoreFor returns the user store of the site serving r.
+func UserStoreFor(r *http.Request) UserStore {
+	return SiteFor(r).Users()
+}
+
+// Middleware finds the site of the request, applies its rules and then
+// answers 404 for the routes it does not serve.
+func (t *SiteTable) Middleware(next http.Handler) http.Handler {
+	serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if site := SiteFor(r); !t.serves(site, r) {
+			WriteError(w, r, NewHTTPError(http.StatusNotFound, "%s not found", r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site := t.Lookup(r.Host)
+		r = r.WithContext(context.WithValue(r.Context(), siteKey, site))
+		t.rulesOf(site).serve(w, r, serve)
+	})
+}
+
+func (t *SiteTable) rulesOf(site *Site) *RuleSet {
+	if site.rules == nil {
+		return t.rules
+	}
+	return site.rules
+}
+
+// serves reports whether site has r's route. Static files are always
+// served, from the site's own dir.
+func (t *SiteTable) serves(site *Site, r *http.Request) bool {
+	if site.routes == nil {
+		return true
+	}
+	if _, pattern := t.mux.Handler(r); pattern == "/" {
+		return true
+	}
+	for _, rt := range site.routes {
+		if rt.matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// DebugRulesHandler is /debug/rules for the site of the URL asked about.
+func (t *SiteTable) DebugRulesHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	host := request.Host
+	if u, err := url.Parse(request.URL.Query().Get("url")); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return t.rulesOf(t.Lookup(host)).DebugHandler(response, request)
+}
+
+// Check is the site's health check: its dir is readable and its own user
+// store, if it has one, answers.
+func (s *Site) Check() error {
+	if err := dirReadable(s.Dir()); err != nil {
+		return err
+	}
+	if s.store != nil {
+		return s.store.Ping()
+	}
+	return nil
+}
+
+// checkSiteFiles reports the sites whose dir or users file is missing.
+func checkSiteFiles(problems *ConfigError, sites map[string]SiteSettings) {
+	for host, ss := range sites {
+		if ss.Dir == "" {
+			// newSite says so
+		} else if fi, err := os.Stat(ss.Dir); err != nil {
+			problems.add("sites: %s: dir: %v", host, err)
+		} else if !fi.IsDir() {
+			problems.add("sites: %s: dir: %s is not a directory", host, ss.Dir)
+		}
+		if ss.UsersPath != "" {
+			if _, err := os.Stat(ss.UsersPath); err != nil {
+				problems.add("sites: %s: users: %v", host, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// siteDir makes a dir whose index.html says name.
+func siteDir(t *testing.T, name string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// hostGet sends GET path to srv for host and returns the response with
+// its body read.
+func hostGet(t *testing.T, srv *httptest.Server, host, path string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+// withSites sets up a wiki that serves a few routes and has rules of its
+// own, tools sites by wildcard and one tools host of its own.
+func withSites(t *testing.T, defaultSite string) func(*Settings) {
+	return func(s *Settings) {
+		if err := os.WriteFile(filepath.Join(s.Dir, "index.html"), []byte("main"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s.Sites = map[string]SiteSettings{
+			"wiki.example.com": {
+				Dir:    siteDir(t, "wiki"),
+				Routes: []string{"/me", "POST /login"},
+				Rules:  map[string]RuleSettings{"start": {Match: "exact", Path: "/start", To: "/", Status: http.StatusFound}},
+			},
+			"*.tools.example.com": {Dir: siteDir(t, "tools")},
+			"a.tools.example.com": {Dir: siteDir(t, "a tools")},
+		}
+		s.DefaultSite = defaultSite
+	}
+}
+
+type siteCase struct {
+	host, path string
+	status     int
+	want       string // in the body, or the Location of a redirect
+}
+
+func checkSites(t *testing.T, srv *httptest.Server, cases []siteCase) {
+	t.Helper()
+	for _, tt := range cases {
+		resp, body := hostGet(t, srv, tt.host, tt.path)
+		got := body
+		if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+			got = resp.Header.Get("Location")
+		}
+		if resp.StatusCode != tt.status || !strings.Contains(got, tt.want) {
+			t.Errorf("GET %s%s: got %s %q, want %d %q", tt.host, tt.path, resp.Status, got, tt.status, tt.want)
+		}
+	}
+}
+
+func TestSites(t *testing.T) {
+	srv := startTestServer(t, withSites(t, ""))
+
+	checkSites(t, srv, []siteCase{
+		// exact hosts, in any case and with a port
+		{"wiki.example.com", "/", http.StatusOK, "wiki"},
+		{"WIKI.Example.com:8080", "/", http.StatusOK, "wiki"},
+
+		// an exact host goes before a wildcard that also takes it
+		{"a.tools.example.com", "/", http.StatusOK, "a tools"},
+		{"b.tools.example.com", "/", http.StatusOK, "tools"},
+		{"x.a.tools.example.com", "/", http.StatusOK, "tools"},
+
+		// a wildcard takes only subdomains; other hosts get the top level
+		{"tools.example.com", "/", http.StatusOK, "main"},
+		{"unknown.example", "/", http.StatusOK, "main"},
+		{"127.0.0.1", "/", http.StatusOK, "main"},
+
+		// the wiki serves its routes, and has its rules in place of the top-level ones
+		{"wiki.example.com", "/me", http.StatusUnauthorized, "not_logged_in"},
+		{"wiki.example.com", "/users", http.StatusNotFound, "/users not found"},
+		{"wiki.example.com", "/user/joesample", http.StatusNotFound, "/user/joesample not found"},
+		{"wiki.example.com", "/start", http.StatusFound, "/"},
+		{"wiki.example.com", "/redirect", http.StatusNotFound, ""},
+
+		// the other sites serve all routes, with the top-level rules
+		{"b.tools.example.com", "/users", http.StatusOK, "joesample"},
+		{"unknown.example", "/user/joesample", http.StatusOK, "joesample"},
+		{"unknown.example", "/redirect", http.StatusTemporaryRedirect, "http://example.org"},
+		{"unknown.example", "/start", http.StatusNotFound, ""},
+	})
+}
+
+func TestSitesDefaultSite(t *testing.T) {
+	srv := startTestServer(t, withSites(t, "wiki.example.com"))
+
+	checkSites(t, srv, []siteCase{
+		{"unknown.example", "/", http.StatusOK, "wiki"},
+		{"unknown.example", "/users", http.StatusNotFound, "/users not found"},
+		{"unknown.example", "/start", http.StatusFound, "/"},
+		{"b.tools.example.com", "/", http.StatusOK, "tools"},
+		{"b.tools.example.com", "/users", http.StatusOK, "joesample"},
+	})
+}
+
+func TestOpenSitesRefuses(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		host     string
+		settings SiteSettings
+		want     string
+	}{
+		{"Wiki.example.com", SiteSettings{Dir: dir}, "is not a lower case host name"},
+		{"*.", SiteSettings{Dir: dir}, "is not a lower case host name"},
+		{"wiki.example.com:8080", SiteSettings{Dir: dir}, "is not a lower case host name"},
+		{"*.*.example.com", SiteSettings{Dir: dir}, "is not a lower case host name"},
+		{"wiki.example.com", SiteSettings{}, "no dir"},
+		{"wiki.example.com", SiteSettings{Dir: dir, Routes: []string{"GET users"}}, "routes"},
+		{"wiki.example.com", SiteSettings{Dir: dir, Rules: map[string]RuleSettings{"bad": {Match: "exact", Path: "x", To: "/"}}}, "is not a path"},
+		{"wiki.example.com", SiteSettings{Dir: dir, UsersPath: "users.json", UserStore: "disk"}, "needs user_store_path"},
+		{"wiki.example.com", SiteSettings{Dir: dir, UsersPath: "users.json", UserStore: "ldap"}, "is not one of file, memory or disk"},
+	} {
+		s := testSettings(t)
+		s.Sites = map[string]SiteSettings{tt.host: tt.settings}
+		_, err := OpenSites(s, nil, http.NewServeMux())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q %+v: got %v, want an error about %q", tt.host, tt.settings, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precompressed are the sibling files StaticHandler looks for, best first.
+var precompressed = []struct{ coding, ext string }{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// StaticHandler serves the files under the configured dir. It resolves
+// index.html for directories, lists them only when dir_listing is on,
+// never leaves dir (even through symlinks) and serves no dotfiles.
+// ETags, Last-Modified, 304s and Range requests come from http.ServeContent.
+func StaticHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		response.Header().Set("Allow", "GET, HEAD")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+	}
+	return nil, ServeStatic(response, request, request.URL.Path)
+}
+
+// ServeStatic sends the file at urlPath, relative to the dir of r's site.
+func ServeStatic(w http.ResponseWriter, r *http.Request, urlPath string) error {
+	settings := Config()
+	name, ok := staticName(urlPath)
+	if !ok {
+		return NewHTTPError(http.StatusNotFound, "%s not found", urlPath)
+	}
+	root, err := os.OpenRoot(SiteFor(r).Dir())
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	info, err := root.Stat(name)
+	if err != nil {
+		return staticError(urlPath, err)
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirectToDir(w, r)
+			return nil
+		}
+		index := path.Join(name, "index.html")
+		if info, err = root.Stat(index); err == nil && !info.IsDir() {
+			name = index
+		} else if settings.DirListing {
+			return listDir(w, r, root, name)
+		} else {
+			return NewHTTPError(http.StatusNotFound, "%s not found", urlPath)
+		}
+	}
+	return serveFile(w, r, root, name, info, settings)
+}
+
+// staticName turns a URL path into a name inside the dir, refusing
+// anything that climbs out of it or touches a dotfile.
+func staticName(urlPath string) (string, bool) {
+	if strings.Contains(urlPath, "\\") || strings.Contains(urlPath, "\x00") {
+		return "", false
+	}
+	for _, part := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", false
+		}
+	}
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, true
+}
+
+// staticError hides why a file could not be had. os.Root has no exported
+// error for a symlink that leads out of the dir, hence the string match.
+func staticError(urlPath string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || strings.Contains(err.Error(), "escapes from parent") {
+		return NewHTTPError(http.StatusNotFound, "%s not found", urlPath)
+	}
+	return err
+}
+
+func redirectToDir(w http.ResponseWriter, r *http.Request) {
+	target := path.Base(r.URL.Path) + "/"
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
+
+// serveFile sends name, or its precompressed sibling when the client
+// takes that encoding and the sibling is not older than the file.
+func serveFile(w http.ResponseWriter, r *http.Request, root *os.Root, name string, info fs.FileInfo, settings *Settings) error {
+	send, sendInfo, coding := name, info, ""
+	vary := false
+	for _, pc := range precompressed {
+		sibling, err := root.Stat(name + pc.ext)
+		if err != nil || sibling.IsDir() || sibling.ModTime().Before(info.ModTime()) {
+			continue
+		}
+		vary = true
+		if send == name && codingQuality(r, pc.coding) > 0 {
+			send, sendInfo, coding = name+pc.ext, sibling, pc.coding
+		}
+	}
+
+	f, err := root.Open(send)
+	if err != nil {
+		return staticError(r.URL.Path, err)
+	}
+	defer f.Close()
+	ctype, err := staticContentType(root, name)
+	if err != nil {
+		return staticError(r.URL.Path, err)
+	}
+
+	// only now that there is a file to send: an error must not go out
+	// cached or encoded
+	h := w.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("X-Content-Type-Options", "nosniff")
+	if cc := settings.cacheControl(name); cc != "" {
+		h.Set("Cache-Control", cc)
+	}
+	if vary {
+		addVary(h, "Accept-Encoding")
+	}
+	tag := ""
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+		tag = "-" + coding
+	}
+	h.Set("ETag", fmt.Sprintf(`"%x-%x%s"`, sendInfo.ModTime().UnixNano(), sendInfo.Size(), tag))
+	http.ServeContent(w, r, name, sendInfo.ModTime(), f)
+	return nil
+}
+
+// staticContentType goes by the file extension, then by sniffing the
+// start of the file the way http.ServeContent would.
+func staticContentType(root *os.Root, name string) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype, nil
+	}
+	f, err := root.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// cacheControl returns the Cache-Control value configured for name's
+// extension, falling back on the "*" entry.
+func (s *Settings) cacheControl(name string) string {
+	if cc, ok := s.CacheControl[strings.ToLower(path.Ext(name))]; ok {
+		return cc
+	}
+	return s.CacheControl["*"]
+}
+
+// codingQuality returns the q value the Accept-Encoding header gives
+// coding; "*" stands in for codings it does not name.
+func codingQuality(r *http.Request, coding string) float64 {
+	star := 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		v := 1.0
+		if qs, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(qs, 64); err == nil {
+				v = f
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case coding:
+			return v
+		case "*":
+			star = v
+		}
+	}
+	return star
+}
+
+var dirListing = template.Must(template.New("dir").Parse(`<!doctype html>
+<html>
+<head>
+  <meta charset='utf-8'>
+  <title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+type dirEntry struct {
+	Name, Href, Size, Modified string
+}
+
+// listDir writes an HTML index of the directory name, skipping dotfiles.
+func listDir(w http.ResponseWriter, r *http.Request, root *os.Root, name string) error {
+	d, err := root.Open(name)
+	if err != nil {
+		return staticError(r.URL.Path, err)
+	}
+	defer d.Close()
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	var entries []dirEntry
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		e := dirEntry{Name: info.Name(), Size: strconv.FormatInt(info.Size(), 10), Modified: info.ModTime().UTC().Format(time.RFC3339)}
+		if info.IsDir() {
+			e.Name += "/"
+			e.Size = "-"
+		}
+		// ./ keeps a name with a colon from reading as a URL scheme
+		e.Href = "./" + (&url.URL{Path: e.Name}).String()
+		entries = append(entries, e)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == "HEAD" {
+		return nil
+	}
+	return dirListing.Execute(w, struct {
+		Path    string
+		Entries []dirEntry
+	}{r.URL.Path, entries})
+}
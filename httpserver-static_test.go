@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// forbidden is the content of every file the static tests must not get.
+const forbidden = "not for the web"
+
+// staticTree fills dir with the files of the static tests, and a secret
+// outside it that symlinks point at.
+func staticTree(t *testing.T, dir string) {
+	t.Helper()
+	outside := t.TempDir()
+	files := map[string]string{
+		filepath.Join(dir, "index.html"):       "<h1>home</h1>",
+		filepath.Join(dir, "a.txt"):            "plain a",
+		filepath.Join(dir, ".secret"):          forbidden,
+		filepath.Join(dir, ".git", "config"):   forbidden,
+		filepath.Join(dir, "sub", "b.txt"):     "plain b",
+		filepath.Join(dir, "sub", ".hidden"):   forbidden,
+		filepath.Join(outside, "secret.txt"):   forbidden,
+		filepath.Join(outside, "index.html"):   forbidden,
+		filepath.Join(dir, "empty", "note.md"): "note",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link.txt": filepath.Join(outside, "secret.txt"),
+		"linkdir":  outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// getRaw sends path to srv as it is, without the client cleaning it up,
+// and returns the response with its body read.
+func getRaw(t *testing.T, srv *httptest.Server, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Opaque = path
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(b)
+}
+
+func startStaticServer(t *testing.T, listing bool) *httptest.Server {
+	return startTestServer(t, func(s *Settings) {
+		staticTree(t, s.Dir)
+		s.DirListing = listing
+		s.CacheControl = map[string]string{"*": "public, max-age=300"}
+	})
+}
+
+func TestStaticFiles(t *testing.T) {
+	srv := startStaticServer(t, false)
+
+	resp, body := getRaw(t, srv, "/a.txt", nil)
+	if resp.StatusCode != http.StatusOK || body != "plain a" {
+		t.Fatalf("GET /a.txt: %s %q", resp.Status, body)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=300" {
+		t.Errorf("Cache-Control %q", cc)
+	}
+	if resp, body := getRaw(t, srv, "/", nil); resp.StatusCode != http.StatusOK || body != "<h1>home</h1>" {
+		t.Errorf("GET /: %s %q", resp.Status, body)
+	}
+	if resp, _ := getRaw(t, srv, "/sub", nil); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "/sub/" {
+		t.Errorf("GET /sub: %s to %q, want a redirect to /sub/", resp.Status, resp.Header.Get("Location"))
+	}
+}
+
+func TestStaticETag(t *testing.T) {
+	srv := startStaticServer(t, false)
+
+	resp, _ := getRaw(t, srv, "/a.txt", nil)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	resp, body := getRaw(t, srv, "/a.txt", http.Header{"If-None-Match": {etag}})
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Errorf("If-None-Match %s: %s %q, want 304", etag, resp.Status, body)
+	}
+	if resp, _ := getRaw(t, srv, "/a.txt", http.Header{"If-None-Match": {`"other"`}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("If-None-Match of another version: %s, want 200", resp.Status)
+	}
+}
+
+func TestStaticRefuses(t *testing.T) {
+	srv := startStaticServer(t, false)
+
+	for _, path := range []string{
+		// climbing out, plain and encoded
+		"/../secret.txt",
+		"/sub/../../secret.txt",
+		"/%2e%2e/secret.txt",
+		"/sub/%2e%2e%2f%2e%2e%2fsecret.txt",
+		"/sub/..%5c..%5csecret.txt",
+		"/a.txt%00.html",
+		// dotfiles
+		"/.secret",
+		"/.git/config",
+		"/sub/.hidden",
+		"/%2esecret",
+		// symlinks out of the dir, which os.Root will not follow
+		"/link.txt",
+		"/linkdir/secret.txt",
+		"/linkdir/",
+		// a directory without index.html, listing off
+		"/empty/",
+		"/missing.txt",
+	} {
+		resp, body := getRaw(t, srv, path, nil)
+		switch {
+		case resp.StatusCode == http.StatusOK, strings.Contains(body, forbidden):
+			t.Errorf("GET %s: %s %q", path, resp.Status, body)
+		case resp.StatusCode == http.StatusNotFound && resp.Header.Get("Cache-Control") == "public, max-age=300":
+			t.Errorf("GET %s: a 404 marked cacheable", path)
+		}
+	}
+}
+
+func TestStaticListing(t *testing.T) {
+	srv := startStaticServer(t, true)
+
+	resp, body := getRaw(t, srv, "/sub/", nil)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `href="./b.txt"`) {
+		t.Fatalf("GET /sub/: %s %q", resp.Status, body)
+	}
+	if strings.Contains(body, `href="./.hidden"`) {
+		t.Errorf("listing shows a dotfile: %q", body)
+	}
+	if resp, _ := getRaw(t, srv, "/linkdir/", nil); resp.StatusCode == http.StatusOK {
+		t.Errorf("listed a directory outside the dir")
+	}
+}
+
+func TestStaticUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads any file")
+	}
+	srv := startTestServer(t, func(s *Settings) {
+		s.CacheControl = map[string]string{"*": "public, max-age=300"}
+		if err := os.WriteFile(filepath.Join(s.Dir, "locked.txt"), []byte(forbidden), 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	resp, body := getRaw(t, srv, "/locked.txt", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /locked.txt: %s %q, want 404", resp.Status, body)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "" {
+		t.Errorf("the 404 has Cache-Control %q", cc)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Templates holds the server's HTML pages.
+var Templates *TemplateRegistry
+
+// View is a typed view model: a struct carrying what one page template
+// needs, which names that template. Handlers return Views and AppHandler
+// renders them; a template error becomes a 500.
+type View interface {
+	Template() string
+}
+
+// Page is embedded in every view model for the layout's benefit.
+type Page struct {
+	Title     string
+	Username  string // logged in user, or ""
+	CSRFToken string // for forms: {{csrfField .CSRFToken}}
+}
+
+func newPage(r *http.Request, title string) Page {
+	return Page{Title: title, Username: CurrentUsername(r), CSRFToken: CSRFToken(r)}
+}
+
+// TemplateRegistry parses the templates directory:
+//
+//	layouts/*.html   templates such as "base" that pages build on
+//	partials/*.html  templates shared between pages
+//	*.html           one page each, named by file name
+//
+// Each page gets its own copy of the layouts and partials, so every page
+// can define blocks like "title" and "content" for them. In dev mode the
+// directory is parsed again on every render so edits show up at once.
+type TemplateRegistry struct {
+	dir string
+
+	mu    sync.RWMutex
+	pages map[string]*template.Template
+}
+
+// LoadTemplates parses every template in dir.
+func LoadTemplates(dir string) (*TemplateRegistry, error) {
+	t := &TemplateRegistry{dir: dir}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TemplateRegistry) load() error {
+	shared := template.New("").Funcs(templateFuncs)
+	for _, sub := range []string{"layouts", "partials"} {
+		files, err := filepath.Glob(filepath.Join(t.dir, sub, "*.html"))
+		if err != nil {
+			return err
+		}
+		if len(files) > 0 {
+			if shared, err = shared.ParseFiles(files...); err != nil {
+				return err
+			}
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(t.dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("templates: no pages in %s", t.dir)
+	}
+	pages := make(map[string]*template.Template, len(files))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(file)
+		clone, err := shared.Clone()
+		if err != nil {
+			return err
+		}
+		page, err := clone.New(name).Parse(string(b))
+		if err != nil {
+			return err
+		}
+		pages[name] = page
+	}
+	t.mu.Lock()
+	t.pages = pages
+	t.mu.Unlock()
+	return nil
+}
+
+// Names lists the pages, for the startup log.
+func (t *TemplateRegistry) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var names []string
+	for name := range t.pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Render executes the page v names into a buffer, so that a failing
+// template sends nothing but the error.
+func (t *TemplateRegistry) Render(v View) (HTML, error) {
+	if Config().DevMode {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+	}
+	t.mu.RLock()
+	page, ok := t.pages[v.Template()]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("templates: no page %q in %s", v.Template(), t.dir)
+	}
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, v); err != nil {
+		return nil, err
+	}
+	return HTML(buf.Bytes()), nil
+}
+
+// renderView turns a View returned by a handler, bare or in a Result, into HTML.
+func renderView(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case View:
+		return Templates.Render(x)
+	case *Result:
+		if view, ok := x.Value.(View); ok {
+			page, err := Templates.Render(view)
+			return &Result{Status: x.Status, Location: x.Location, Value: page}, err
+		}
+	}
+	return v, nil
+}
+
+var templateFuncs = template.FuncMap{
+	"join":      strings.Join,
+	"csrfField": csrfFieldHTML,
+}
+
+// RequestInfo is what the debug pages show about a request.
+type RequestInfo struct {
+	Method     string
+	RequestURI string
+	Path       string
+	Form       url.Values
+	Cookies    []string // names only; the values are secrets
+}
+
+func newRequestInfo(r *http.Request) RequestInfo {
+	info := RequestInfo{
+		Method:     r.Method,
+		RequestURI: r.RequestURI,
+		Path:       r.URL.Path,
+		Form:       url.Values{},
+	}
+	for key, values := range r.Form {
+		if strings.Contains(strings.ToLower(key), "password") {
+			values = []string{"********"}
+		}
+		info.Form[key] = values
+	}
+	for _, c := range r.Cookies() {
+		info.Cookies = append(info.Cookies, c.Name)
+	}
+	return info
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TLSEnabled reports whether the server should listen with HTTPS.
+func (s *Settings) TLSEnabled() bool {
+	return s.DevTLS || s.TLSCert != ""
+}
+
+// EnableTLS configures server for HTTPS and HTTP/2. With -dev-tls it first
+// makes (or reuses) a self-signed certificate in settings.DevTLSDir.
+// It returns the function that starts serving.
+func EnableTLS(server *Server, settings *Settings) (func() error, error) {
+	cert, key := settings.TLSCert, settings.TLSKey
+	if settings.DevTLS {
+		var err error
+		cert, key, err = devCertificate(settings.DevTLSDir, settings.Host)
+		if err != nil {
+			return nil, fmt.Errorf("dev TLS certificate: %v", err)
+		}
+		Logger.Info("using self-signed development certificate", "cert", cert)
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	return func() error {
+		return server.ListenAndServeTLS(cert, key)
+	}, nil
+}
+
+// StartHTTPSRedirect listens for plain HTTP on settings.HTTPRedirectPort and
+// sends every request to the HTTPS port with the configured redirect code.
+// With a host name configured, only it and the hosts of the sites are
+// redirected to themselves; any other Host header goes to the configured
+// host, so the listener cannot be used to send people elsewhere.
+func StartHTTPSRedirect(server *Server, settings *Settings) {
+	redirect := &http.Server{
+		Addr:              net.JoinHostPort(settings.Host, strconv.Itoa(settings.HTTPRedirectPort)),
+		ReadHeaderTimeout: settings.ReadHeaderTimeout,
+		IdleTimeout:       settings.IdleTimeout,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := redirectHost(settings.Host, r.Host)
+			if settings.Port != 443 {
+				host = net.JoinHostPort(host, strconv.Itoa(settings.Port))
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), Config().RedirectCode)
+		}),
+	}
+	go func() {
+		Logger.Info("redirecting http to https", "addr", redirect.Addr, "https_port", settings.Port)
+		if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Logger.Error("https redirect listener", "err", err)
+		}
+	}()
+	server.OnShutdown("https redirect", func(ctx context.Context) error {
+		return redirect.Shutdown(ctx)
+	})
+}
+
+// redirectHost is the host, without a port, that StartHTTPSRedirect sends a
+// request for requestHost to. When configured is a wildcard address such
+// as "" or "0.0.0.0" the server answers for any name, and requestHost is
+// kept. Otherwise requestHost is kept when it is configured or a site's
+// host, and anything else goes to configured.
+func redirectHost(configured, requestHost string) string {
+	host, _, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		host = requestHost
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	wildcard := configured == ""
+	if ip := net.ParseIP(configured); ip != nil && ip.IsUnspecified() {
+		wildcard = true
+	}
+	if host != "" && !strings.ContainsAny(host, "/\\@?# ") {
+		if wildcard || hostMatches(configured, host) {
+			return host
+		}
+		if Sites != nil {
+			for _, site := range Sites.All() {
+				if hostMatches(site.Name, host) {
+					return host
+				}
+			}
+		}
+	}
+	if wildcard {
+		// no usable Host header and no name to fall back on
+		return "localhost"
+	}
+	return configured
+}
+
+// devCertificate returns the paths of a self-signed certificate and key for
+// localhost (and host), generating them unless a usable pair is cached in dir.
+func devCertificate(dir, host string) (certPath, keyPath string, err error) {
+	certPath = filepath.Join(dir, "dev-cert.pem")
+	keyPath = filepath.Join(dir, "dev-key.pem")
+	if cachedCertUsable(certPath, keyPath, host) {
+		return certPath, keyPath, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"httpserver development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	} else if host != "" && host != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return "", "", err
+	}
+	if err := writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return "", "", err
+	}
+	return certPath, keyPath, nil
+}
+
+// cachedCertUsable reports whether the cached pair loads, covers host
+// and is good for at least another day.
+func cachedCertUsable(certPath, keyPath, host string) bool {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Until(cert.NotAfter) < 24*time.Hour {
+		return false
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return cert.VerifyHostname(host) == nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestRedirectHost(t *testing.T) {
+	startTestServer(t, func(s *Settings) {
+		s.Sites = map[string]SiteSettings{
+			"wiki.example.com":    {Dir: t.TempDir()},
+			"*.tools.example.com": {Dir: t.TempDir()},
+		}
+	})
+
+	for _, tt := range []struct {
+		configured, requestHost, want string
+	}{
+		// a wildcard bind answers for any name
+		{"", "www.example.org", "www.example.org"},
+		{"0.0.0.0", "www.example.org:80", "www.example.org"},
+		{"::", "WWW.Example.org.", "www.example.org"},
+		{"0.0.0.0", "", "localhost"},
+		{"0.0.0.0", "evil.com/x", "localhost"},
+
+		// a configured name takes everything but itself and the sites
+		{"example.com", "example.com:8080", "example.com"},
+		{"example.com", "evil.com", "example.com"},
+		{"example.com", "wiki.example.com", "wiki.example.com"},
+		{"example.com", "x.tools.example.com", "x.tools.example.com"},
+		{"example.com", "tools.example.com", "example.com"},
+		{"example.com", "evil.com/x.tools.example.com", "example.com"},
+		{"example.com", "", "example.com"},
+	} {
+		if got := redirectHost(tt.configured, tt.requestHost); got != tt.want {
+			t.Errorf("redirectHost(%q, %q) = %q, want %q", tt.configured, tt.requestHost, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultUsersPageSize = 20
+	maxUsersPageSize     = 100
+	maxNameLength        = 100
+)
+
+var usernamePattern = regexp.MustCompile(`^\w{1,64}$`)
+
+// userResource is the JSON shape of a user in the /users and /user/ API.
+type userResource struct {
+	Username  string   `json:"username"`
+	Firstname string   `json:"firstname"`
+	Lastname  string   `json:"lastname"`
+	Name      string   `json:"name"`
+	Roles     []string `json:"roles"`
+}
+
+func newUserResource(u *User) userResource {
+	roles := u.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return userResource{Username: u.Username, Firstname: u.Firstname, Lastname: u.Lastname, Name: u.FullName(), Roles: roles}
+}
+
+// userInput is a POST, PUT or PATCH request body. Pointers tell
+// a missing field apart from an empty one.
+type userInput struct {
+	Username  *string   `json:"username"`
+	Firstname *string   `json:"firstname"`
+	Lastname  *string   `json:"lastname"`
+	Roles     *[]string `json:"roles"`
+}
+
+// fieldErrors maps a field name to what is wrong with it (422 responses).
+type fieldErrors map[string]string
+
+func decodeUserInput(r *http.Request) (*userInput, error) {
+	var in userInput
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, badRequestBody(err, "invalid JSON body: %v", err)
+	}
+	return &in, nil
+}
+
+func validateRoles(errs fieldErrors, roles *[]string) {
+	if roles == nil {
+		return
+	}
+	for _, role := range *roles {
+		if !usernamePattern.MatchString(role) {
+			errs["roles"] = fmt.Sprintf("%q is not a valid role name", role)
+			return
+		}
+	}
+}
+
+func validateName(errs fieldErrors, field string, v *string, required bool) {
+	switch {
+	case v == nil:
+		if required {
+			errs[field] = "is required"
+		}
+	case strings.TrimSpace(*v) == "":
+		errs[field] = "must not be blank"
+	case len(*v) > maxNameLength:
+		errs[field] = fmt.Sprintf("must be at most %d characters", maxNameLength)
+	}
+}
+
+// UsersHandler serves the /users collection:
+//
+//	GET  /users?offset=0&limit=20&q=smith   list users, q filters on any name
+//	POST /users                             create a user
+func UsersHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	if request.URL.Path != "/users" {
+		return nil, NewHTTPError(http.StatusNotFound, "404 page not found")
+	}
+	switch request.Method {
+	case "GET", "HEAD":
+		return listUsers(response, request)
+	case "POST":
+		return createUser(response, request)
+	default:
+		response.Header().Set("Allow", "GET, HEAD, POST")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+	}
+}
+
+func listUsers(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	query := request.URL.Query()
+	errs := fieldErrors{}
+	offset := queryInt(errs, query.Get("offset"), "offset", 0)
+	limit := queryInt(errs, query.Get("limit"), "limit", defaultUsersPageSize)
+	if limit < 1 || limit > maxUsersPageSize {
+		errs["limit"] = fmt.Sprintf("must be between 1 and %d", maxUsersPageSize)
+	}
+	if len(errs) > 0 {
+		return nil, NewHTTPError(http.StatusUnprocessableEntity, "invalid query").WithFields(errs)
+	}
+
+	users, err := UserStoreFor(request).List()
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]userResource, 0, len(users))
+	for _, u := range users {
+		if userMatches(u, query.Get("q"), query.Get("firstname"), query.Get("lastname")) {
+			matches = append(matches, newUserResource(u))
+		}
+	}
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return map[string]interface{}{
+		"users":  matches[offset:end],
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	}, nil
+}
+
+func queryInt(errs fieldErrors, v, field string, def int) int {
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		errs[field] = "must be a non-negative integer"
+		return def
+	}
+	return n
+}
+
+// userMatches reports whether u passes the list filters: q is a case-insensitive
+// substring of the username or full name, firstname and lastname match exactly.
+func userMatches(u *User, q, firstname, lastname string) bool {
+	if firstname != "" && !strings.EqualFold(u.Firstname, firstname) {
+		return false
+	}
+	if lastname != "" && !strings.EqualFold(u.Lastname, lastname) {
+		return false
+	}
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	return strings.Contains(strings.ToLower(u.Username), q) ||
+		strings.Contains(strings.ToLower(u.FullName()), q)
+}
+
+// checkRolesWrite refuses to let anyone but an admin set roles, whatever
+// the access policy lets through to the users API.
+func checkRolesWrite(r *http.Request) error {
+	if user, err := UserStoreFor(r).Lookup(CurrentUsername(r)); err == nil && user.HasAnyRole([]string{RoleAdmin}) {
+		return nil
+	}
+	return NewHTTPError(http.StatusForbidden, "only users with the role %s may change roles", RoleAdmin).WithCode("forbidden")
+}
+
+func createUser(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	in, err := decodeUserInput(request)
+	if err != nil {
+		return nil, err
+	}
+	errs := fieldErrors{}
+	if in.Username == nil {
+		errs["username"] = "is required"
+	} else if !usernamePattern.MatchString(*in.Username) {
+		errs["username"] = "must be 1 to 64 letters, digits or underscores"
+	}
+	validateName(errs, "firstname", in.Firstname, true)
+	validateName(errs, "lastname", in.Lastname, true)
+	validateRoles(errs, in.Roles)
+	if len(errs) > 0 {
+		return nil, NewHTTPError(http.StatusUnprocessableEntity, "invalid user").WithFields(errs)
+	}
+	if in.Roles != nil {
+		if err := checkRolesWrite(request); err != nil {
+			return nil, err
+		}
+	}
+
+	user := &User{Username: *in.Username, Firstname: *in.Firstname, Lastname: *in.Lastname}
+	if in.Roles != nil {
+		user.Roles = *in.Roles
+	}
+	if err := UserStoreFor(request).Create(user); err != nil {
+		return nil, err
+	}
+	resource := newUserResource(user)
+	Events.PublishSite(SiteFor(request).usersSite(), "user.created", resource)
+	return Created("/user/"+user.Username, resource), nil
+}
+
+// updateUser handles PUT (replace; firstname and lastname required)
+// and PATCH (only the given fields change) on /user/{name}.
+func updateUser(response http.ResponseWriter, request *http.Request, userName string) (interface{}, error) {
+	in, err := decodeUserInput(request)
+	if err != nil {
+		return nil, err
+	}
+	user, err := UserStoreFor(request).Lookup(userName)
+	if err != nil {
+		return nil, err
+	}
+
+	replace := request.Method == "PUT"
+	errs := fieldErrors{}
+	if in.Username != nil && *in.Username != userName {
+		errs["username"] = "cannot be changed"
+	}
+	validateName(errs, "firstname", in.Firstname, replace)
+	validateName(errs, "lastname", in.Lastname, replace)
+	validateRoles(errs, in.Roles)
+	if len(errs) > 0 {
+		return nil, NewHTTPError(http.StatusUnprocessableEntity, "invalid user").WithFields(errs)
+	}
+	// a PUT without roles takes them away
+	if in.Roles != nil || (replace && len(user.Roles) > 0) {
+		if err := checkRolesWrite(request); err != nil {
+			return nil, err
+		}
+	}
+
+	if in.Firstname != nil {
+		user.Firstname = *in.Firstname
+	}
+	if in.Lastname != nil {
+		user.Lastname = *in.Lastname
+	}
+	if in.Roles != nil {
+		user.Roles = *in.Roles
+	} else if replace {
+		user.Roles = nil
+	}
+	if err := UserStoreFor(request).Update(user); err != nil {
+		return nil, err
+	}
+	resource := newUserResource(user)
+	Events.PublishSite(SiteFor(request).usersSite(), "user.updated", resource)
+	return resource, nil
+}
+
+func deleteUser(response http.ResponseWriter, request *http.Request, userName string) (interface{}, error) {
+	if err := UserStoreFor(request).Delete(userName); err != nil {
+		return nil, err
+	}
+	Events.PublishSite(SiteFor(request).usersSite(), "user.deleted", map[string]string{"username": userName})
+	return NoContent, nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/l3x/jsoncfgo"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
+
+type User struct {
+	Username     string   `json:"-"`
+	Firstname    string   `json:"firstname"`
+	Lastname     string   `json:"lastname"`
+	PasswordHash string   `json:"password_hash,omitempty"` // bcrypt; see SetPassword
+	Roles        []string `json:"roles,omitempty"`
+}
+
+func (u *User) FullName() string {
+	return u.Firstname + " " + u.Lastname
+}
+
+// UserStore is where UserHandler finds its users.
+// Lookup, Update and Delete return ErrUserNotFound for unknown usernames
+// and Create returns ErrUserExists for taken ones.
+// Ping reports whether the store can still serve requests.
+type UserStore interface {
+	Lookup(username string) (*User, error)
+	List() ([]*User, error)
+	Create(u *User) error
+	Update(u *User) error
+	Delete(username string) error
+	Ping() error
+	Close() error
+}
+
+// OpenUserStore returns the store named by kind ("file", "memory" or "disk").
+// The file and memory stores are seeded from usersPath; the disk store keeps
+// its own journal at storePath and is seeded from usersPath the first time.
+func OpenUserStore(kind, usersPath, storePath string) (UserStore, error) {
+	switch kind {
+	case "file":
+		return NewFileUserStore(usersPath)
+	case "memory":
+		users, err := readUsersFile(usersPath)
+		if err != nil {
+			return nil, err
+		}
+		return NewMemoryUserStore(users...), nil
+	case "disk":
+		return NewDiskUserStore(storePath, usersPath)
+	}
+	return nil, fmt.Errorf("unknown user store %q (want file, memory or disk)", kind)
+}
+
+// readUsersFile loads every user in a users.json file, which maps
+// usernames to objects with firstname, lastname and optional password_hash
+// and roles keys.
+func readUsersFile(path string) ([]*User, error) {
+	obj, err := jsoncfgo.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, name := range objKeys(obj) {
+		userObj := obj.OptionalObject(name)
+		u := &User{
+			Username:     name,
+			Firstname:    userObj.OptionalString("firstname", ""),
+			Lastname:     userObj.OptionalString("lastname", ""),
+			PasswordHash: userObj.OptionalString("password_hash", ""),
+			Roles:        userObj.OptionalList("roles"),
+		}
+		if err := userObj.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", path, name, err)
+		}
+		users = append(users, u)
+	}
+	if err := obj.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return users, nil
+}
+
+// writeUsersFile replaces path with the given users, in users.json layout.
+func writeUsersFile(path string, users []*User) error {
+	data := make(map[string]*User, len(users))
+	for _, u := range users {
+		data[u.Username] = u
+	}
+	b, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'), 0644)
+}
+
+// writeFileAtomic replaces path with b by way of a temporary file, so that
+// readers see the old file or the new one and never half of it. The file
+// keeps the mode it had; a new one gets perm.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes it 0600
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// objKeys returns the sorted keys of a jsoncfgo object, skipping the
+// underscore-prefixed bookkeeping entries jsoncfgo adds as keys are read.
+func objKeys(obj jsoncfgo.Obj) []string {
+	var keys []string
+	for k := range obj {
+		if !strings.HasPrefix(k, "_") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MemoryUserStore keeps users in a map. It is handy in tests and is the
+// building block of the file and disk stores.
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+// copyUser returns a copy of u that shares no Roles with it, so that a
+// caller editing a user cannot change the store's copy behind its lock.
+func copyUser(u User) *User {
+	u.Roles = append([]string(nil), u.Roles...)
+	return &u
+}
+
+func NewMemoryUserStore(users ...*User) *MemoryUserStore {
+	s := &MemoryUserStore{users: make(map[string]User)}
+	for _, u := range users {
+		s.users[u.Username] = *copyUser(*u)
+	}
+	return s
+}
+
+func (s *MemoryUserStore) Lookup(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(u), nil
+}
+
+func (s *MemoryUserStore) List() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.list(), nil
+}
+
+func (s *MemoryUserStore) list() []*User {
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+func (s *MemoryUserStore) Create(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.create(u)
+}
+
+func (s *MemoryUserStore) create(u *User) error {
+	if _, ok := s.users[u.Username]; ok {
+		return ErrUserExists
+	}
+	s.users[u.Username] = *copyUser(*u)
+	return nil
+}
+
+func (s *MemoryUserStore) Update(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(u)
+}
+
+func (s *MemoryUserStore) update(u *User) error {
+	if _, ok := s.users[u.Username]; !ok {
+		return ErrUserNotFound
+	}
+	s.users[u.Username] = *copyUser(*u)
+	return nil
+}
+
+func (s *MemoryUserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delete(username)
+}
+
+func (s *MemoryUserStore) delete(username string) error {
+	if _, ok := s.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, username)
+	return nil
+}
+
+func (s *MemoryUserStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return nil
+}
+
+func (s *MemoryUserStore) Close() error { return nil }
+
+// FileUserStore serves the users in a users.json file and rewrites
+// the whole file after every change.
+type FileUserStore struct {
+	*MemoryUserStore
+	path    string
+	written fileStamp // the file as the last save left it
+}
+
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	users, err := readUsersFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileUserStore{MemoryUserStore: NewMemoryUserStore(users...), path: path}, nil
+}
+
+func (s *FileUserStore) Create(u *User) error {
+	return s.modify(func() error { return s.create(u) })
+}
+
+func (s *FileUserStore) Update(u *User) error {
+	return s.modify(func() error { return s.update(u) })
+}
+
+func (s *FileUserStore) Delete(username string) error {
+	return s.modify(func() error { return s.delete(username) })
+}
+
+// Ping checks that the users file is still there to be rewritten.
+func (s *FileUserStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, err := os.Stat(s.path)
+	return err
+}
+
+// Reload replaces the users with those in the file, which someone
+// may have edited by hand. The old users stay if the file is broken.
+func (s *FileUserStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users, err := readUsersFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.users = make(map[string]User, len(users))
+	for _, u := range users {
+		s.users[u.Username] = *u
+	}
+	return nil
+}
+
+// modify applies change and saves the file, rolling the change back if the save fails.
+func (s *FileUserStore) modify(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := make(map[string]User, len(s.users))
+	for k, v := range s.users {
+		before[k] = v
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	if err := writeUsersFile(s.path, s.list()); err != nil {
+		s.users = before
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.written = fileStamp{info.ModTime(), info.Size()}
+	}
+	return nil
+}
+
+// Written is the modification time and size of the file as the store
+// last saved it, or the zero fileStamp if it has not saved it.
+func (s *FileUserStore) Written() fileStamp {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.written
+}
+
+// DiskUserStore is a small embedded database: every change is appended
+// to a journal file as one JSON record, and the journal is replayed when
+// the store is opened. Close compacts the journal down to one record per user.
+type DiskUserStore struct {
+	*MemoryUserStore
+	path    string
+	journal *os.File
+}
+
+type journalRecord struct {
+	Op   string `json:"op"` // "put" or "delete"
+	Name string `json:"name"`
+	User *User  `json:"user,omitempty"`
+}
+
+// NewDiskUserStore opens the journal at path, creating it from the users
+// in seedPath when it does not exist yet.
+func NewDiskUserStore(path, seedPath string) (*DiskUserStore, error) {
+	s := &DiskUserStore{MemoryUserStore: NewMemoryUserStore(), path: path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		users, err := readUsersFile(seedPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			s.users[u.Username] = *u
+		}
+		if err := s.compact(); err != nil {
+			return nil, err
+		}
+	} else if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = f
+	return s, nil
+}
+
+func (s *DiskUserStore) replay() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("%s:%d: %v", s.path, line, err)
+		}
+		switch {
+		case rec.Op == "put" && rec.User != nil:
+			rec.User.Username = rec.Name
+			s.users[rec.Name] = *rec.User
+		case rec.Op == "delete":
+			delete(s.users, rec.Name)
+		default:
+			return fmt.Errorf("%s:%d: bad journal record", s.path, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the journal with one put record per user.
+func (s *DiskUserStore) compact() error {
+	var b []byte
+	for _, u := range s.list() {
+		line, err := json.Marshal(journalRecord{Op: "put", Name: u.Username, User: u})
+		if err != nil {
+			return err
+		}
+		b = append(append(b, line...), '\n')
+	}
+	return writeFileAtomic(s.path, b, 0600)
+}
+
+func (s *DiskUserStore) append(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.journal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.journal.Sync()
+}
+
+func (s *DiskUserStore) Create(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.create(u); err != nil {
+		return err
+	}
+	if err := s.append(journalRecord{Op: "put", Name: u.Username, User: u}); err != nil {
+		delete(s.users, u.Username)
+		return err
+	}
+	return nil
+}
+
+func (s *DiskUserStore) Update(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.users[u.Username]
+	if err := s.update(u); err != nil {
+		return err
+	}
+	if err := s.append(journalRecord{Op: "put", Name: u.Username, User: u}); err != nil {
+		s.users[u.Username] = old
+		return err
+	}
+	return nil
+}
+
+func (s *DiskUserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.users[username]
+	if err := s.delete(username); err != nil {
+		return err
+	}
+	if err := s.append(journalRecord{Op: "delete", Name: username}); err != nil {
+		s.users[username] = old
+		return err
+	}
+	return nil
+}
+
+// Ping checks that the journal is open and still on disk.
+func (s *DiskUserStore) Ping() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.journal == nil {
+		return errors.New("user store is closed")
+	}
+	_, err := os.Stat(s.path)
+	return err
+}
+
+func (s *DiskUserStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.journal.Close()
+	s.journal = nil
+	if err != nil {
+		return err
+	}
+	return s.compact()
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The parts of RFC 6455 that /ws needs: text messages, ping, pong and
+// close, no extensions. A WSConn has a write goroutine of its own, so
+// that a slow client holds up nothing but its own send queue.
+
+const (
+	wsMaxMessage   = 64 << 10         // bytes; bigger messages close the connection
+	wsSendQueue    = 64               // messages waiting to be written
+	wsPingInterval = 30 * time.Second // how often the server pings
+	wsPongWait     = 2 * wsPingInterval
+	wsWriteWait    = 10 * time.Second
+	wsAcceptGUID   = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// close codes
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsProtocolError   = 1002
+	wsUnsupportedData = 1003
+	wsInvalidPayload  = 1007
+	wsPolicyViolation = 1008
+	wsMessageTooBig   = 1009
+	wsTryAgainLater   = 1013
+)
+
+// ErrWSClosed is returned when sending on a connection that is closing.
+var ErrWSClosed = errors.New("websocket: connection closed")
+
+// wsConns are the open connections, for CloseWebSockets.
+var wsConns = struct {
+	sync.Mutex
+	m    map[*WSConn]bool
+	open sync.WaitGroup
+}{m: make(map[*WSConn]bool)}
+
+type wsFrame struct {
+	opcode  byte
+	payload []byte
+}
+
+// WSConn is a server side WebSocket connection.
+type WSConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	send     chan wsFrame  // data frames, bounded
+	control  chan wsFrame  // pongs, ahead of data
+	closing  chan wsFrame  // the close frame, ahead of everything
+	done     chan struct{} // closed by Close
+	readDone chan struct{} // closed when ReadMessages returns
+
+	closeOnce sync.Once
+}
+
+// UpgradeWebSocket answers a WebSocket handshake and takes over the
+// connection. Headers already set on w, such as cookies and the request
+// id, go out with the 101 response. The handshake fails with an
+// *HTTPError for the caller to send.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		return nil, NewHTTPError(http.StatusUpgradeRequired, "this endpoint only speaks WebSocket").WithCode("websocket_required")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, NewHTTPError(http.StatusUpgradeRequired, "unsupported WebSocket version").WithCode("websocket_version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, NewHTTPError(http.StatusBadRequest, "invalid Sec-WebSocket-Key")
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be taken over
+		return nil, NewHTTPError(http.StatusHTTPVersionNotSupported, "WebSocket needs HTTP/1.1: %v", err)
+	}
+	// the server's read and write timeouts were for the HTTP request
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	h := w.Header().Clone()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sum[:]))
+	var resp bytes.Buffer
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(&resp)
+	resp.WriteString("\r\n")
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := conn.Write(resp.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &WSConn{
+		conn:     conn,
+		br:       brw.Reader,
+		send:     make(chan wsFrame, wsSendQueue),
+		control:  make(chan wsFrame, 1),
+		closing:  make(chan wsFrame, 1),
+		done:     make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	wsConns.Lock()
+	wsConns.m[c] = true
+	wsConns.open.Add(1)
+	wsConns.Unlock()
+	go c.writeLoop()
+	return c, nil
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CloseWebSockets tells every client the server is going away, and
+// waits for the connections to close or ctx to end. The http.Server
+// forgot about them when they were upgraded.
+func CloseWebSockets(ctx context.Context) error {
+	wsConns.Lock()
+	for c := range wsConns.m {
+		c.Close(wsGoingAway, "server shutting down")
+	}
+	wsConns.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		wsConns.open.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send queues a text message, waiting while the queue is full: that is
+// how a client that reads slowly slows down its own requests.
+func (c *WSConn) Send(msg []byte) error {
+	select {
+	case c.send <- wsFrame{wsText, msg}:
+		return nil
+	case <-c.done:
+		return ErrWSClosed
+	}
+}
+
+// TrySend queues a text message unless the queue is full.
+func (c *WSConn) TrySend(msg []byte) bool {
+	select {
+	case c.send <- wsFrame{wsText, msg}:
+		return true
+	case <-c.done:
+	default:
+	}
+	return false
+}
+
+// Close starts the closing handshake: the close frame goes out ahead of
+// anything still queued, and the client gets a moment to answer it.
+func (c *WSConn) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+		c.closing <- wsFrame{wsClose, payload}
+		close(c.done)
+		c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	})
+}
+
+func (c *WSConn) writeLoop() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		wsConns.Lock()
+		delete(wsConns.m, c)
+		wsConns.open.Done()
+		wsConns.Unlock()
+	}()
+	for {
+		var f wsFrame
+		select {
+		case f = <-c.closing:
+		default:
+			select {
+			case f = <-c.closing:
+			case f = <-c.control:
+			case f = <-c.send:
+			case <-ticker.C:
+				f = wsFrame{opcode: wsPing}
+			}
+		}
+		if err := c.writeFrame(f); err != nil {
+			c.Close(wsGoingAway, "")
+			return
+		}
+		if f.opcode == wsClose {
+			// give the client a moment to answer with its own close
+			select {
+			case <-c.readDone:
+			case <-time.After(time.Second):
+			}
+			return
+		}
+	}
+}
+
+func (c *WSConn) writeFrame(f wsFrame) error {
+	var header [10]byte
+	header[0] = 0x80 | f.opcode // FIN: messages are never fragmented
+	n := 2
+	switch l := len(f.payload); {
+	case l < 126:
+		header[1] = byte(l)
+	case l <= 0xFFFF:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(l))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(l))
+		n = 10
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := c.conn.Write(header[:n]); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(f.payload)
+	return err
+}
+
+// wsCloseError is a protocol problem that ends the connection with code.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.code, e.reason)
+}
+
+// ReadMessages calls handle with each text message until the connection
+// closes, answering pings and closes along the way. It returns when the
+// client goes away or breaks the protocol, having closed the connection.
+func (c *WSConn) ReadMessages(handle func(msg []byte)) error {
+	defer close(c.readDone)
+	err := c.readLoop(handle)
+	var ce *wsCloseError
+	switch {
+	case errors.As(err, &ce):
+		c.Close(ce.code, ce.reason)
+	default:
+		c.Close(wsGoingAway, "")
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (c *WSConn) readLoop(handle func(msg []byte)) error {
+	var msg []byte
+	var msgOp byte
+	for {
+		select {
+		case <-c.done:
+			// closing: keep reading only to see the client's close frame
+		default:
+			c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		}
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case wsPing:
+			select {
+			case c.control <- wsFrame{wsPong, payload}:
+			default: // a pong is already waiting to go out
+			}
+		case wsPong:
+		case wsClose:
+			code := wsNormalClosure
+			switch {
+			case len(payload) == 1:
+				return &wsCloseError{wsProtocolError, "close frame with half a code"}
+			case len(payload) >= 2:
+				code = int(binary.BigEndian.Uint16(payload))
+				if !wsCloseCodeValid(code) {
+					return &wsCloseError{wsProtocolError, fmt.Sprintf("invalid close code %d", code)}
+				}
+				if !utf8.Valid(payload[2:]) {
+					return &wsCloseError{wsInvalidPayload, "close reason is not UTF-8"}
+				}
+			}
+			c.Close(code, "")
+			return io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if opcode == wsContinuation {
+				if msgOp == 0 {
+					return &wsCloseError{wsProtocolError, "unexpected continuation frame"}
+				}
+			} else {
+				if msgOp != 0 {
+					return &wsCloseError{wsProtocolError, "expected a continuation frame"}
+				}
+				msgOp = opcode
+			}
+			if len(msg)+len(payload) > wsMaxMessage {
+				return &wsCloseError{wsMessageTooBig, fmt.Sprintf("messages are limited to %d bytes", wsMaxMessage)}
+			}
+			msg = append(msg, payload...)
+			if !fin {
+				continue
+			}
+			op := msgOp
+			m := msg
+			msg, msgOp = nil, 0
+			if op == wsBinary {
+				return &wsCloseError{wsUnsupportedData, "binary messages are not supported"}
+			}
+			if !utf8.Valid(m) {
+				return &wsCloseError{wsInvalidPayload, "text message is not UTF-8"}
+			}
+			select {
+			case <-c.done:
+			default:
+				handle(m)
+			}
+		default:
+			return &wsCloseError{wsProtocolError, fmt.Sprintf("unknown opcode %d", opcode)}
+		}
+	}
+}
+
+// wsCloseCodeValid reports whether a client may send code in a close frame
+// (RFC 6455 section 7.4). 1004 is reserved, 1005, 1006 and 1015 stand for
+// closes without a frame, and the rest below 3000 are not yet assigned.
+func wsCloseCodeValid(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *WSConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		err = &wsCloseError{wsProtocolError, "reserved bits set"}
+		return
+	}
+	if header[1]&0x80 == 0 {
+		err = &wsCloseError{wsProtocolError, "client frames must be masked"}
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		err = &wsCloseError{wsProtocolError, "invalid control frame"}
+		return
+	}
+	if length > wsMaxMessage {
+		err = &wsCloseError{wsMessageTooBig, fmt.Sprintf("messages are limited to %d bytes", wsMaxMessage)}
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketHandler serves /ws to logged in users. Every message is a JSON
+// object. Requests carry a method and, when they want an answer, an id:
+//
+//	{"id": 1, "method": "ping"}                                  -> {"id": 1, "result": "pong"}
+//	{"id": 2, "method": "user.get", "params": {"username": "joesample"}}
+//	                                                             -> {"id": 2, "result": {user}}
+//	{"id": 3, "method": "subscribe", "params": {"topics": ["user"]}}
+//	                                                             -> {"id": 3, "result": {"topics": ["user"]}}
+//	{"id": 4, "method": "unsubscribe"}                           -> {"id": 4, "result": {}}
+//
+// Errors come back as {"id": ..., "error": {problem document}}, and the
+// events of a subscription, as on /events, as {"event": {...}}. A client
+// that lets its events pile up is disconnected with 1013 (try again later),
+// and one whose session ends, by logging out or expiring, with 1008.
+func WebSocketHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	username := CurrentUsername(request)
+	if username == "" {
+		return nil, NewHTTPError(http.StatusUnauthorized, "log in to use %s", request.URL.Path).WithCode("not_logged_in")
+	}
+	if !wsOriginAllowed(request) {
+		return nil, NewHTTPError(http.StatusForbidden, "origin %q is not allowed", request.Header.Get("Origin")).WithCode("ws_origin")
+	}
+	conn, err := UpgradeWebSocket(response, request)
+	if err != nil {
+		return nil, err
+	}
+	s := &wsSession{conn: conn, request: request, sess: CurrentSession(request)}
+	defer s.unsubscribe()
+	Logger.Debug("websocket open", "request_id", RequestID(request), "user", username)
+	done := make(chan struct{})
+	go s.watchSession(done)
+	err = conn.ReadMessages(s.handle)
+	close(done)
+	Logger.Debug("websocket closed", "request_id", RequestID(request), "user", username, "err", err)
+	return nil, nil
+}
+
+// wsOriginAllowed keeps other sites' pages from using a visitor's session:
+// browsers must come from this server or an origin the cors section lets
+// send credentials, as a socket always carries the session cookie. Other
+// clients send no Origin.
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return Config().CORS.trusts(origin)
+}
+
+type wsRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type wsResponse struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *Problem        `json:"error,omitempty"`
+	Event  *Event          `json:"event,omitempty"`
+}
+
+// wsSession is the state of one /ws connection.
+type wsSession struct {
+	conn    *WSConn
+	request *http.Request // the upgrade request, for error documents
+
+	mu   sync.Mutex
+	sub  *Subscription
+	sess *Session // the login, as of the last check; nil once it ended
+}
+
+// checkSession closes the connection unless the user is still logged in.
+func (s *wsSession) checkSession() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sess != nil {
+		s.sess = Sessions.Refresh(s.sess)
+	}
+	if s.sess == nil {
+		s.conn.Close(wsPolicyViolation, "session ended")
+		return false
+	}
+	return true
+}
+
+// watchSession checks the session of an idle connection, and keeps up
+// with its rotations, until done is closed.
+func (s *wsSession) watchSession(done <-chan struct{}) {
+	ticker := time.NewTicker(sessionRecheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.checkSession() {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *wsSession) handle(msg []byte) {
+	if !s.checkSession() {
+		return
+	}
+	var req wsRequest
+	var result interface{}
+	err := json.Unmarshal(msg, &req)
+	if err != nil {
+		err = NewHTTPError(http.StatusBadRequest, "invalid JSON message: %v", err)
+	} else {
+		result, err = s.call(req)
+	}
+	if len(req.ID) == 0 && err == nil {
+		return // a notification: no answer wanted
+	}
+	resp := wsResponse{ID: req.ID, Result: result}
+	if err != nil {
+		resp.Error = newProblem(s.request, err)
+	}
+	b, _ := json.Marshal(resp)
+	s.conn.Send(b)
+}
+
+func (s *wsSession) call(req wsRequest) (interface{}, error) {
+	switch req.Method {
+	case "ping":
+		return "pong", nil
+	case "user.get":
+		var params struct {
+			Username string `json:"username"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Username == "" {
+			return nil, NewHTTPError(http.StatusBadRequest, "user.get needs params {\"username\": ...}")
+		}
+		user, err := UserStoreFor(s.request).Lookup(params.Username)
+		if err != nil {
+			return nil, err
+		}
+		return newUserResource(user), nil
+	case "subscribe":
+		var params struct {
+			Topics []string `json:"topics"`
+		}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return nil, NewHTTPError(http.StatusBadRequest, "subscribe takes params {\"topics\": [...]}")
+			}
+		}
+		s.subscribe(params.Topics)
+		if params.Topics == nil {
+			params.Topics = []string{}
+		}
+		return map[string][]string{"topics": params.Topics}, nil
+	case "unsubscribe":
+		s.unsubscribe()
+		return struct{}{}, nil
+	}
+	return nil, NewHTTPError(http.StatusBadRequest, "unknown method %q", req.Method).WithCode("unknown_method")
+}
+
+// subscribe replaces the session's subscription with one to topics.
+func (s *wsSession) subscribe(topics []string) {
+	sub, _, _ := Events.Subscribe(SiteFor(s.request).usersSite(), topics, 0)
+	s.mu.Lock()
+	old := s.sub
+	s.sub = sub
+	s.mu.Unlock()
+	if old != nil {
+		Events.Unsubscribe(old)
+	}
+	go s.forward(sub)
+}
+
+func (s *wsSession) unsubscribe() {
+	s.mu.Lock()
+	old := s.sub
+	s.sub = nil
+	s.mu.Unlock()
+	if old != nil {
+		Events.Unsubscribe(old)
+	}
+}
+
+// forward passes sub's events on without waiting for the client.
+func (s *wsSession) forward(sub *Subscription) {
+	for e := range sub.C {
+		b, _ := json.Marshal(wsResponse{Event: &e})
+		if !s.conn.TrySend(b) {
+			s.conn.Close(wsTryAgainLater, "too slow to keep up with events")
+			return
+		}
+	}
+	s.mu.Lock()
+	current := s.sub == sub
+	s.mu.Unlock()
+	switch {
+	case !current:
+	case Events.Closed():
+		s.conn.Close(wsGoingAway, "server shutting down")
+	default:
+		// the hub dropped us for falling behind
+		s.conn.Close(wsTryAgainLater, "too slow to keep up with events")
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestConn is the client end of a /ws connection.
+type wsTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS sends the handshake for /ws with c's cookies and origin, if not
+// "". It returns the response and, if it was a 101, the connection.
+func dialWS(t *testing.T, srv *httptest.Server, c *testClient, origin string) (*http.Response, *wsTestConn) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Accept", "application/json")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	u, _ := url.Parse(srv.URL)
+	for _, cookie := range c.http.Jar.Cookies(u) {
+		req.AddCookie(cookie)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, nil
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return resp, &wsTestConn{t: t, conn: conn, br: br}
+}
+
+// write sends a masked frame, as clients must.
+func (ws *wsTestConn) write(opcode byte, payload []byte) {
+	ws.t.Helper()
+	frame := []byte{0x80 | opcode}
+	switch l := len(payload); {
+	case l < 126:
+		frame = append(frame, 0x80|byte(l))
+	default:
+		frame = append(frame, 0x80|126, byte(l>>8), byte(l))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := ws.conn.Write(frame); err != nil {
+		ws.t.Fatal(err)
+	}
+}
+
+func (ws *wsTestConn) writeClose(code int) {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	ws.write(wsClose, payload)
+}
+
+// read returns the next frame other than a ping.
+func (ws *wsTestConn) read() (byte, []byte) {
+	ws.t.Helper()
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+			ws.t.Fatalf("reading frame: %v", err)
+		}
+		length := int(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var ext [2]byte
+			io.ReadFull(ws.br, ext[:])
+			length = int(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			io.ReadFull(ws.br, ext[:])
+			length = int(binary.BigEndian.Uint64(ext[:]))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ws.br, payload); err != nil {
+			ws.t.Fatalf("reading frame: %v", err)
+		}
+		if opcode := header[0] & 0x0F; opcode != wsPing {
+			return opcode, payload
+		}
+	}
+}
+
+// call sends a request and decodes the answer to it.
+func (ws *wsTestConn) call(request string) map[string]json.RawMessage {
+	ws.t.Helper()
+	ws.write(wsText, []byte(request))
+	return ws.readMessage()
+}
+
+func (ws *wsTestConn) readMessage() map[string]json.RawMessage {
+	ws.t.Helper()
+	opcode, payload := ws.read()
+	if opcode != wsText {
+		ws.t.Fatalf("got opcode %d %q, want a text message", opcode, payload)
+	}
+	var msg map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		ws.t.Fatalf("message %s: %v", payload, err)
+	}
+	return msg
+}
+
+// expectClose reads the server's close frame, checks its code and then
+// that the server hangs up.
+func (ws *wsTestConn) expectClose(code int) {
+	ws.t.Helper()
+	opcode, payload := ws.read()
+	if opcode != wsClose || len(payload) < 2 {
+		ws.t.Fatalf("got opcode %d %q, want a close frame", opcode, payload)
+	}
+	if got := int(binary.BigEndian.Uint16(payload)); got != code {
+		ws.t.Fatalf("got close %d %q, want %d", got, payload[2:], code)
+	}
+	if _, err := ws.br.ReadByte(); err != io.EOF {
+		ws.t.Fatalf("after the close: got %v, want EOF", err)
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	srv := startTestServer(t, func(s *Settings) {
+		s.CORS.Origins = []string{"https://app.example"}
+		s.CORS.Credentials = true
+	})
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+
+	resp, ws := dialWS(t, srv, c, "")
+	if ws == nil {
+		t.Fatalf("handshake: %s", resp.Status)
+	}
+	// the example in RFC 6455 section 1.3
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept %q", got)
+	}
+	if !headerHasToken(resp.Header, "Connection", "upgrade") || !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		t.Errorf("101 without the upgrade headers: %v", resp.Header)
+	}
+
+	// the same origin as the server's is fine
+	if resp, ws := dialWS(t, srv, c, srv.URL); ws == nil {
+		t.Errorf("handshake from %s: %s", srv.URL, resp.Status)
+	}
+	// and so is one the cors section lets send credentials
+	if resp, ws := dialWS(t, srv, c, "https://app.example"); ws == nil {
+		t.Errorf("handshake from https://app.example: %s", resp.Status)
+	}
+
+	if resp, _ := c.do("GET", "/ws", nil); resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("plain GET /ws: got %s, want 426", resp.Status)
+	}
+}
+
+func TestWebSocketRejects(t *testing.T) {
+	srv := startTestServer(t, func(s *Settings) {
+		s.CORS.Origins = []string{"https://public.example"}
+	})
+
+	anonymous := newTestClient(t, srv)
+	if resp, _ := dialWS(t, srv, anonymous, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("anonymous: got %s, want 401", resp.Status)
+	}
+
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+	if resp, _ := dialWS(t, srv, c, "https://evil.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bad origin: got %s, want 403", resp.Status)
+	}
+	// allowed to read the API, but not to use a visitor's session
+	if resp, _ := dialWS(t, srv, c, "https://public.example"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("origin without credentials: got %s, want 403", resp.Status)
+	}
+}
+
+func TestWebSocketRequests(t *testing.T) {
+	srv := startTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+	_, ws := dialWS(t, srv, c, "")
+
+	msg := ws.call(`{"id": 1, "method": "ping"}`)
+	if string(msg["id"]) != "1" || string(msg["result"]) != `"pong"` {
+		t.Errorf("ping: %v", msg)
+	}
+
+	msg = ws.call(`{"id": "u", "method": "user.get", "params": {"username": "joesample"}}`)
+	var user struct {
+		Username  string `json:"username"`
+		Firstname string `json:"firstname"`
+	}
+	if string(msg["id"]) != `"u"` || json.Unmarshal(msg["result"], &user) != nil || user.Username != "joesample" || user.Firstname != "Joe" {
+		t.Errorf("user.get: %v", msg)
+	}
+
+	var problem Problem
+	msg = ws.call(`{"id": 2, "method": "user.get", "params": {"username": "nobody"}}`)
+	if json.Unmarshal(msg["error"], &problem) != nil || problem.Status != http.StatusNotFound {
+		t.Errorf("user.get of a missing user: %v", msg)
+	}
+	msg = ws.call(`{"id": 3, "method": "frobnicate"}`)
+	if json.Unmarshal(msg["error"], &problem) != nil || problem.Code != "unknown_method" {
+		t.Errorf("unknown method: %v", msg)
+	}
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	srv := startTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+	_, ws := dialWS(t, srv, c, "")
+
+	msg := ws.call(`{"id": 1, "method": "subscribe", "params": {"topics": ["user"]}}`)
+	if string(msg["result"]) != `{"topics":["user"]}` {
+		t.Fatalf("subscribe: %v", msg)
+	}
+
+	admin := newTestClient(t, srv)
+	admin.login("joesample")
+	if resp, body := admin.do("PATCH", "/user/alicesmith", map[string]string{"firstname": "Alicia"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PATCH: %s %s", resp.Status, body)
+	}
+
+	var event struct {
+		Topic string `json:"topic"`
+		Data  struct {
+			Username  string `json:"username"`
+			Firstname string `json:"firstname"`
+		} `json:"data"`
+	}
+	msg = ws.readMessage()
+	if err := json.Unmarshal(msg["event"], &event); err != nil {
+		t.Fatalf("got %v, want an event", msg)
+	}
+	if event.Topic != "user.updated" || event.Data.Username != "alicesmith" || event.Data.Firstname != "Alicia" {
+		t.Errorf("event: %+v", event)
+	}
+
+	if msg := ws.call(`{"id": 2, "method": "unsubscribe"}`); string(msg["result"]) != "{}" {
+		t.Errorf("unsubscribe: %v", msg)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	srv := startTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+
+	_, ws := dialWS(t, srv, c, "")
+	ws.writeClose(wsNormalClosure)
+	ws.expectClose(wsNormalClosure)
+
+	_, ws = dialWS(t, srv, c, "")
+	ws.writeClose(4000)
+	ws.expectClose(4000)
+
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1015, 2000, 5000} {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			_, ws := dialWS(t, srv, c, "")
+			ws.t = t
+			ws.writeClose(code)
+			ws.expectClose(wsProtocolError)
+		})
+	}
+
+	_, ws = dialWS(t, srv, c, "")
+	ws.write(wsClose, []byte{0x03})
+	ws.expectClose(wsProtocolError)
+}
+
+func TestWebSocketLogout(t *testing.T) {
+	srv := startTestServer(t, nil)
+	c := newTestClient(t, srv)
+	c.login("alicesmith")
+	_, ws := dialWS(t, srv, c, "")
+	if msg := ws.call(`{"id": 1, "method": "ping"}`); string(msg["result"]) != `"pong"` {
+		t.Fatalf("ping: %v", msg)
+	}
+
+	if resp, body := c.do("POST", "/logout", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout: %s %s", resp.Status, body)
+	}
+	ws.write(wsText, []byte(`{"id": 2, "method": "ping"}`))
+	ws.expectClose(wsPolicyViolation)
+}
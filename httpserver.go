@@ -2,51 +2,43 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"log"
+	"log/slog"
 	"errors"
 	"net/http"
-	"io/ioutil"
-	"html/template"
 	"regexp"
-	"encoding/json"
-	"github.com/l3x/jsoncfgo"
-	"github.com/go-goodies/go_utils"
 )
 
-var Dir string
-var Users jsoncfgo.Obj
-var AppContext *go_utils.Singleton
+var Store UserStore
+var Sessions *SessionManager
+var Auth *Authenticator
 
-func HtmlFileHandler(response http.ResponseWriter, request *http.Request, filename string){
-	response.Header().Set("Content-type", "text/html")
-	webpage, err := ioutil.ReadFile(Dir + filename)  // read whole the file
-	if err != nil {
-		http.Error(response, fmt.Sprintf("%s file error %v", filename, err), 500)
-	}
-	fmt.Fprint(response, string(webpage));
+func HtmlFileHandler(response http.ResponseWriter, request *http.Request, filename string) (interface{}, error) {
+	return nil, ServeStatic(response, request, filename)
+}
+
+type HelpView struct {
+	Page
 }
 
-func HelpHandler(response http.ResponseWriter, request *http.Request){
-	HtmlFileHandler(response, request, "/help.html")
+func (HelpView) Template() string { return "help.html" }
+
+func HelpHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	return HelpView{ newPage(request, "go web server example") }, nil
 }
 
-func AjaxHandler(response http.ResponseWriter, request *http.Request){
-	HtmlFileHandler(response, request, "/ajax.html")
+func AjaxHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
+	return HtmlFileHandler(response, request, "/ajax.html")
 }
 
 func printCookies(response http.ResponseWriter, request *http.Request) {
-	cookieNameForUsername := AppContext.Data["CookieNameForUsername"].(string)
-	fmt.Println("COOKIES:")
 	for _, cookie := range request.Cookies() {
-		fmt.Printf("%v: %v\n", cookie.Name, cookie.Value)
-		if cookie.Name == cookieNameForUsername {
-			SetUsernameCookie(response, cookie.Value)
-		}
-	}; fmt.Println("")
+		Logger.Debug("cookie", "request_id", RequestID(request), "name", cookie.Name)
+	}
 }
 
-func UserHandler(response http.ResponseWriter, request *http.Request){
-	response.Header().Set("Content-type", "application/json")
+func UserHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
 	// json data to send to client
 	data := map[string]string { "api" : "user", "name" : "" }
 	userApiURL := regexp.MustCompile(`^/user/(\w+)$`)
@@ -56,123 +48,110 @@ func UserHandler(response http.ResponseWriter, request *http.Request){
 		printCookies(response, request)
 		var userName string
 		userName = usernameMatches[1]  // ex: joesample
-		userObj := AppContext.Data[userName]
-		fmt.Printf("userObj: %v\n", userObj)
-		if userObj == nil {
-			msg := fmt.Sprintf("Invalid username (%s)", userName)
-			panic(errors.New(msg))
+		switch request.Method {
+		case "GET", "HEAD":
+		case "PUT", "PATCH":
+			return updateUser(response, request, userName)
+		case "DELETE":
+			return deleteUser(response, request, userName)
+		default:
+			response.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+			return nil, NewHTTPError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+		}
+		thisUser, err := UserStoreFor(request).Lookup(userName)
+		if err == ErrUserNotFound {
+			return nil, NewHTTPError(http.StatusNotFound, "Invalid username (%s)", userName).WithCode("user_not_found")
+		} else if err != nil {
+			return nil, err
 		} else {
 			// Send JSON to the client
-			thisUser := userObj.(jsoncfgo.Obj)
-			fmt.Printf("thisUser: %v\n", thisUser)
-			data["name"] = thisUser["firstname"].(string) + " " + thisUser["lastname"].(string)
+			data["name"] = thisUser.FullName()
+			data["username"] = thisUser.Username
+			data["firstname"] = thisUser.Firstname
+			data["lastname"] = thisUser.Lastname
 		}
-		json_bytes, _ := json.Marshal(data)
-		fmt.Printf("json_bytes: %s\n", string(json_bytes[:]))
-		fmt.Fprintf(response, "%s\n", json_bytes)
+		Logger.Debug("user api", "request_id", RequestID(request), "data", data)
+		return data, nil
 
 	} else {
-		http.Error(response, "404 page not found", 404)
+		return nil, NewHTTPError(http.StatusNotFound, "404 page not found")
 	}
 }
 
-func SetUsernameCookie(response http.ResponseWriter, userName string){
-	// Add cookie to response
-	cookieName := AppContext.Data["CookieNameForUsername"].(string)
-	cookie := http.Cookie{Name: cookieName, Value: userName}
-	http.SetCookie(response, &cookie)
+type DebugFormView struct {
+	Page
+	Request RequestInfo
 }
 
-func DebugFormHandler(response http.ResponseWriter, request *http.Request){
+func (DebugFormView) Template() string { return "debug_form.html" }
+
+type DebugQueryView struct {
+	Page
+	Request RequestInfo
+}
+
+func (DebugQueryView) Template() string { return "debug_query.html" }
+
+func DebugFormHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
 
 	printCookies(response, request)
 
 	err := request.ParseForm()  // Parse URL and POST data into request.Form
 	if err != nil {
-		http.Error(response, fmt.Sprintf("error parsing url %v", err), 500)
+		return nil, badRequestBody(err, "error parsing url %v", err)
 	}
 
-	// Set cookie and MIME type in the HTTP headers.
-	fmt.Printf("request.Form: %v\n", request.Form)
-	if request.Form["username"] != nil {
-		cookieVal := request.Form["username"][0]
-		fmt.Printf("cookieVal: %s\n", cookieVal)
-		SetUsernameCookie(response, cookieVal)
-	}; fmt.Println("")
+	view := DebugFormView{ Page: newPage(request, "Debug Info (POST form)"), Request: newRequestInfo(request) }
 
-	templateHandler(response, request)
-	response.Header().Set("Content-type", "text/plain")
+	// Start a session for the user.
+	Logger.Debug("debug form", "request_id", RequestID(request), "form", view.Request.Form)
+	if request.Form["username"] != nil {
+		userName := request.Form["username"][0]
+		if _, err := Auth.Authenticate(SiteFor(request), userName, request.Form.Get("password")); err != nil {
+			return nil, err
+		}
+		if _, err := Sessions.Login(response, request, userName); err != nil {
+			return nil, err
+		}
+		view.Username = userName
+	}
 
 	// Send debug diagnostics to client
-	fmt.Fprintf(response, "<table>")
-	fmt.Fprintf(response, "<tr><td><strong>request.Method    </strong></td><td>'%v'</td></tr>", request.Method)
-	fmt.Fprintf(response, "<tr><td><strong>request.RequestURI</strong></td><td>'%v'</td></tr>", request.RequestURI)
-	fmt.Fprintf(response, "<tr><td><strong>request.URL.Path  </strong></td><td>'%v'</td></tr>", request.URL.Path)
-	fmt.Fprintf(response, "<tr><td><strong>request.Form      </strong></td><td>'%v'</td></tr>", request.Form)
-	fmt.Fprintf(response, "<tr><td><strong>request.Cookies() </strong></td><td>'%v'</td></tr>", request.Cookies())
-	fmt.Fprintf(response, "</table>")
-
+	return view, nil
 }
 
-func DebugQueryHandler(response http.ResponseWriter, request *http.Request){
-
-	// Set cookie and MIME type in the HTTP headers.
-	response.Header().Set("Content-type", "text/plain")
+func DebugQueryHandler(response http.ResponseWriter, request *http.Request) (interface{}, error) {
 
 	// Parse URL and POST data into the request.Form
 	err := request.ParseForm()
 	if err != nil {
-		http.Error(response, fmt.Sprintf("error parsing url %v", err), 500)
+		return nil, badRequestBody(err, "error parsing url %v", err)
 	}
 
 	// Send debug diagnostics to client
-	fmt.Fprintf(response, " request.Method     '%v'\n", request.Method)
-	fmt.Fprintf(response, " request.RequestURI '%v'\n", request.RequestURI)
-	fmt.Fprintf(response, " request.URL.Path   '%v'\n", request.URL.Path)
-	fmt.Fprintf(response, " request.Form       '%v'\n", request.Form)
-	fmt.Fprintf(response, " request.Cookies()  '%v'\n", request.Cookies())
-}
-
-func templateHandler(w http.ResponseWriter, r *http.Request) {
-	t, _ := template.New("form.html").Parse(form)
-	t.Execute(w, "")
-}
-
-func formHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Form)
-	templateHandler(w, r)
+	return DebugQueryView{ Page: newPage(request, "Debug Info (GET request)"), Request: newRequestInfo(request) }, nil
 }
 
-var form = `
-<h1>Debug Info (POST form)</h1>
-<form method="POST" action="" name="frmTest">
-<div>
-    <label for="username">User Name</label>
-    <input id="username" name="username" placeholder="joesample, alicesmith, or bobbrown" required="" type="text"
-size="50">
-</div>
-<div><input type="submit" value="Submit"></div>
-</form>
-
-</form>
-`
-
-func errorHandler(f func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Println("errorHandler...")
+func errorHandler(f func(http.ResponseWriter, *http.Request) error) AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		Logger.Debug("errorHandler...")
 		err := f(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("handling %q: %v", r.RequestURI, err)
+			Logger.Debug("handler failed", "request_id", RequestID(r), "uri", r.RequestURI, "err", err)
 		}
+		return nil, err
 	}
 }
 
+func notFoundHandler(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return nil, NewHTTPError(http.StatusNotFound, "404 page not found")
+}
+
 func doThis() error { return nil }
 func doThat() error { return errors.New("ERROR - doThat") }
 
 func wrappedHandler(w http.ResponseWriter, r *http.Request) error {
-	log.Println("betterHandler...")
+	Logger.Debug("betterHandler...")
 	if err := doThis(); err != nil {
 		return fmt.Errorf("doing this: %v", err)
 	}
@@ -185,71 +164,175 @@ func wrappedHandler(w http.ResponseWriter, r *http.Request) error {
 
 
 func main() {
-	cfg := jsoncfgo.Load("/Users/lex/dev/go/data/webserver/webserver-config.json")
-
-	host := cfg.OptionalString("host", "localhost")
-	fmt.Printf("host: %v\n", host)
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		if err := runPasswd(os.Args[2:]); err != nil {
+			log.Fatalf("ERROR - passwd...\n%v", err)
+		}
+		return
+	}
 
-	port := cfg.OptionalInt("port", 8080)
-	fmt.Printf("port: %v\n", port)
+	settings, err := LoadSettings(os.Args[1:])
+	if err != nil {
+		log.Fatalf("ERROR - Invalid configuration...\n%v", err)
+	}
+	config.Store(settings)
+	SetLogLevel(settings.LogLevel)
+	Logger, _ = NewLogger(settings.LogFormat)
+	slog.SetDefault(Logger)
 
-	Dir = cfg.OptionalString("dir", "www/")
-	fmt.Printf("web_dir: %v\n", Dir)
+	host := settings.Host
+	port := settings.Port
+	Logger.Info("config", "file", settings.ConfigPath, "host", host, "port", port, "web_dir", settings.Dir, "redirect_code", settings.RedirectCode)
 
-	redirect_code := cfg.OptionalInt("redirect_code", 307)
-	fmt.Printf("redirect_code: %v\n\n", redirect_code)
+	Templates, err = LoadTemplates(settings.TemplateDir)
+	if err != nil {
+		log.Fatalf("ERROR - Unable to load templates...\n%v", err)
+	}
+	Logger.Info("templates", "dir", settings.TemplateDir, "pages", Templates.Names(), "dev_mode", settings.DevMode)
 
 	mux := http.NewServeMux()
 
-	fileServer := http.Dir(Dir)
-	fileHandler := http.FileServer(fileServer)
-	mux.Handle("/", fileHandler)
+	mux.Handle("/", AppHandler( StaticHandler ))
+
+	mux.Handle("/notFound", AppHandler( notFoundHandler ))
+
+	mux.Handle("/help", AppHandler( HelpHandler ))
 
-	rdh := http.RedirectHandler("http://example.org", redirect_code)
-	mux.Handle("/redirect", rdh)
-	mux.Handle("/notFound", http.NotFoundHandler())
+	mux.Handle("/debugForm", AppHandler( DebugFormHandler ))
+	mux.Handle("/debugQuery", AppHandler( DebugQueryHandler ))
+
+	// /redirect is a rule in the config file now
+	rules, _ := NewRuleSet(settings.Rules)
+	Sites, err = OpenSites(settings, rules, mux)
+	if err != nil {
+		log.Fatalf("ERROR - Unable to open sites...\n%v", err)
+	}
+	for _, site := range Sites.All() {
+		Logger.Info("site", "hosts", site.Name, "dir", site.Dir(), "own_users", site.store != nil, "default", site.Name == settings.DefaultSite)
+	}
+	mux.Handle("/debug/rules", AppHandler( Sites.DebugRulesHandler ))
 
-	mux.Handle("/help", http.HandlerFunc( HelpHandler ))
+	mux.Handle("/user/", AppHandler( UserHandler ))
+	mux.Handle("/users", AppHandler( UsersHandler ))
+	mux.Handle("/ajax", AppHandler( AjaxHandler ))
 
-	mux.Handle("/debugForm", http.HandlerFunc( DebugFormHandler ))
-	mux.Handle("/debugQuery", http.HandlerFunc( DebugQueryHandler ))
+	mux.Handle("/login", AppHandler( LoginHandler ))
+	mux.Handle("/logout", AppHandler( LogoutHandler ))
+	mux.Handle("/me", AppHandler( MeHandler ))
 
-	mux.Handle("/user/", http.HandlerFunc( UserHandler ))
-	mux.Handle("/ajax", http.HandlerFunc( AjaxHandler ))
+	Events = NewHub(settings.EventsReplay)
+	mux.Handle("/events", AppHandler( EventsHandler ))
+	mux.Handle("/ws", AppHandler( WebSocketHandler ))
 
 	mux.Handle("/adapter", errorHandler(wrappedHandler))
 
-	log.Printf("Running on port %d\n", port)
+	metrics := NewMetrics(mux)
+	mux.Handle("/metrics", metrics)
+
+	health := NewHealth()
+	mux.Handle("/healthz", AppHandler( health.LiveHandler ))
+	mux.Handle("/readyz", AppHandler( health.ReadyHandler ))
+	mux.Handle("/version", AppHandler( VersionHandler ))
+
+	proxies, err := MountProxies(mux, settings.Proxies)
+	if err != nil {
+		log.Fatalf("ERROR - Unable to set up proxy routes...\n%v", err)
+	}
 
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	Users := jsoncfgo.Load("/Users/lex/dev/go/data/webserver/users.json")
-
-	joesample := Users.OptionalObject("joesample")
-	fmt.Printf("joesample: %v\n", joesample)
-	fmt.Printf("joesample['firstname']: %v\n", joesample["firstname"])
-	fmt.Printf("joesample['lastname']: %v\n\n", joesample["lastname"])
-
-	alicesmith := Users.OptionalObject("alicesmith")
-	fmt.Printf("alicesmith: %v\n", alicesmith)
-	fmt.Printf("alicesmith['firstname']: %v\n", alicesmith["firstname"])
-	fmt.Printf("alicesmith['lastname']: %v\n\n", alicesmith["lastname"])
-
-	bobbrown := Users.OptionalObject("bobbrown")
-	fmt.Printf("bobbrown: %v\n", bobbrown)
-	fmt.Printf("bobbrown['firstname']: %v\n", bobbrown["firstname"])
-	fmt.Printf("bobbrown['lastname']: %v\n\n", bobbrown["lastname"])
-
-	AppContext = go_oops.NewSingleton()
-	AppContext.Data["CookieNameForUsername"] = "testapp-username"
-	AppContext.Data["joesample"] = joesample
-	AppContext.Data["alicesmith"] = alicesmith
-	AppContext.Data["bobbrown"] = bobbrown
-	fmt.Printf("AppContext: %v\n", AppContext)
-	fmt.Printf("AppContext.Data[\"joesample\"]: %v\n", AppContext.Data["joesample"])
-	fmt.Printf("AppContext.Data[\"alicesmith\"]: %v\n", AppContext.Data["alicesmith"])
-	fmt.Printf("AppContext.Data[\"bobbrown\"]: %v\n\n", AppContext.Data["bobbrown"])
-
-	err := http.ListenAndServe(addr, mux)
-	fmt.Println(err.Error())
+	Store, err = OpenUserStore(settings.UserStore, settings.UsersPath, settings.UserStorePath)
+	if err != nil {
+		log.Fatalf("ERROR - Unable to open %s user store...\n%v", settings.UserStore, err)
+	}
+	users, _ := Store.List()
+	Logger.Info("user store", "kind", settings.UserStore, "users", len(users))
+
+	Sessions, err = NewSessionManager(settings)
+	if err != nil {
+		log.Fatalf("ERROR - Unable to start %s session store...\n%v", settings.SessionStore, err)
+	}
+	Logger.Info("sessions", "store", settings.SessionStore)
+
+	Auth = NewAuthenticator(settings)
+
+	health.AddCheck("config", func() error {
+		if Config() == nil {
+			return errors.New("no configuration loaded")
+		}
+		return nil
+	})
+	health.AddCheck("user_store", Store.Ping)
+	health.AddCheck("www", func() error { return dirReadable(Config().Dir) })
+	for _, site := range Sites.All() {
+		health.AddCheck("site "+site.Name, site.Check)
+	}
+
+	access, _ := NewAccessPolicy(settings.Access)
+	limiter, _ := NewRateLimiter(settings.Limits)
+
+	reloader := NewReloader(os.Args[1:])
+	reloader.OnReload(func(s *Settings) {
+		SetLogLevel(s.LogLevel)
+		policy, _ := NewAccessPolicy(s.Access)
+		access.Replace(policy)
+		limits, _ := NewRateLimiter(s.Limits)
+		limiter.Replace(limits)
+		ruleSet, _ := NewRuleSet(s.Rules)
+		rules.Replace(ruleSet)
+	})
+
+	handler := Chain(mux,
+		RequestIDs,
+		metrics.Middleware,
+		AccessLog,
+		// Compress holds small responses back, so it goes outside Recover:
+		// the guard Recover sets up must see what WriteError writes at once
+		Compress,
+		Recover,
+		CORS,
+		// picks the site and applies its rules; rewrites go first, so the
+		// rest sees the path that is served
+		Sites.Middleware,
+		Sessions.Middleware,
+		// before CSRF, which may read a form body
+		limiter.Middleware,
+		CSRF,
+		access.Middleware,
+	)
+	server := NewServer(settings, addr, handler)
+	// event streams never finish by themselves; end them when shutdown starts
+	server.RegisterOnShutdown(Events.Close)
+	server.OnShutdown("user store", Closer(Store.Close))
+	server.OnShutdown("site user stores", Closer(Sites.Close))
+	server.OnShutdown("sessions", Closer(Sessions.Close))
+	server.OnShutdown("websockets", CloseWebSockets)
+	for _, proxy := range proxies {
+		proxy.Start()
+		server.OnShutdown("proxy "+proxy.prefix, Closer(proxy.Stop))
+	}
+	stopWatching := reloader.Watch(settings.ReloadInterval)
+	server.OnShutdown("config watcher", Closer(func() error {
+		stopWatching()
+		return nil
+	}))
+
+	serve := server.ListenAndServe
+	if settings.TLSEnabled() {
+		serve, err = EnableTLS(server, settings)
+		if err != nil {
+			log.Fatalf("ERROR - Unable to enable TLS...\n%v", err)
+		}
+		if settings.HTTPRedirectPort != 0 {
+			StartHTTPSRedirect(server, settings)
+		}
+	}
+
+	Logger.Info("running", "addr", addr, "tls", settings.TLSEnabled())
+	err = server.Run(serve)
+	if err != nil {
+		Logger.Error("server failed", "err", err)
+		os.Exit(1)
+	}
+	Logger.Info("server stopped")
 }
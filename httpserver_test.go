@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	// set once: handlers of a finished test may still be logging
+	Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// testUsers seed the user store of startTestServer.
+func testUsers() []*User {
+	return []*User{
+		{Username: "joesample", Firstname: "Joe", Lastname: "Sample", Roles: []string{RoleAdmin}},
+		{Username: "alicesmith", Firstname: "Alice", Lastname: "Smith"},
+	}
+}
+
+// testSettings are the defaults of the config file, with everything kept
+// in memory and passwordless logins for testUsers.
+func testSettings(t *testing.T) *Settings {
+	return &Settings{
+		Host:              "127.0.0.1",
+		Dir:               t.TempDir(),
+		RedirectCode:      http.StatusTemporaryRedirect,
+		UserStore:         "memory",
+		SessionStore:      "memory",
+		SessionCookie:     "testapp-session",
+		SessionSecret:     strings.Repeat("s", 32),
+		SessionTTL:        time.Hour,
+		SessionRotate:     time.Hour,
+		PasswordlessLogin: true,
+		PasswordCost:      bcrypt.MinCost,
+		LoginMaxAttempts:  5,
+		LoginLockout:      time.Minute,
+		Access:            defaultAccess,
+		Limits:            defaultLimits,
+		Rules:             defaultRules,
+		Sites:             map[string]SiteSettings{},
+		CORS:              CORSSettings{Methods: defaultCORSMethods, Headers: defaultCORSHeaders, ExposeHeaders: defaultCORSExposeHeaders},
+		EventsReplay:      16,
+		EventsHeartbeat:   time.Second,
+	}
+}
+
+// startTestServer serves the routes, proxies and middleware of main, minus
+// the pages that need templates, from an httptest.Server. configure, if not
+// nil, changes the settings first.
+func startTestServer(t *testing.T, configure func(*Settings)) *httptest.Server {
+	t.Helper()
+	s := testSettings(t)
+	if configure != nil {
+		configure(s)
+	}
+	config.Store(s)
+
+	var err error
+	Store = NewMemoryUserStore(testUsers()...)
+	Sessions, err = NewSessionManager(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Auth = NewAuthenticator(s)
+	Events = NewHub(s.EventsReplay)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", AppHandler(StaticHandler))
+	mux.Handle("/user/", AppHandler(UserHandler))
+	mux.Handle("/users", AppHandler(UsersHandler))
+	mux.Handle("/login", AppHandler(LoginHandler))
+	mux.Handle("/logout", AppHandler(LogoutHandler))
+	mux.Handle("/me", AppHandler(MeHandler))
+	mux.Handle("/events", AppHandler(EventsHandler))
+	mux.Handle("/ws", AppHandler(WebSocketHandler))
+	metrics := NewMetrics(mux)
+	mux.Handle("/metrics", metrics)
+	proxies, err := MountProxies(mux, s.Proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := NewRuleSet(s.Rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Sites, err = OpenSites(s, rules, mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, err := NewAccessPolicy(s.Access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := NewRateLimiter(s.Limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(Chain(mux,
+		RequestIDs,
+		metrics.Middleware,
+		Recover,
+		CORS,
+		Sites.Middleware,
+		Sessions.Middleware,
+		limiter.Middleware,
+		CSRF,
+		access.Middleware,
+	))
+	for _, proxy := range proxies {
+		proxy.Start()
+	}
+	events, sessions := Events, Sessions
+	t.Cleanup(func() {
+		for _, proxy := range proxies {
+			proxy.Stop()
+		}
+		events.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		CloseWebSockets(ctx)
+		srv.Close()
+		sessions.Close()
+	})
+	return srv
+}
+
+// testClient talks JSON to a test server, with cookies and CSRF tokens.
+type testClient struct {
+	t    *testing.T
+	base string
+	http *http.Client
+}
+
+func newTestClient(t *testing.T, srv *httptest.Server) *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{t: t, base: srv.URL, http: &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// do sends a request with body (if not nil) as JSON and returns the
+// response with its body read.
+func (c *testClient) do(method, path string, body interface{}) (*http.Response, []byte) {
+	c.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := c.cookie(csrfCookie); token != "" {
+		req.Header.Set(csrfHeader, token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, b
+}
+
+// login logs in as username and fails the test if that does not work.
+func (c *testClient) login(username string) {
+	c.t.Helper()
+	resp, body := c.do("POST", "/login", map[string]string{"username": username})
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("login %s: %s %s", username, resp.Status, body)
+	}
+}
+
+func (c *testClient) cookie(name string) string {
+	u, _ := url.Parse(c.base)
+	for _, cookie := range c.http.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}